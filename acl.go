@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+)
+
+// sourceACL decides which client addresses a forward accepts. A deny
+// match always rejects; when allow is non-empty the client must match it.
+type sourceACL struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// parsePrefixes reads CIDRs, accepting bare addresses as single hosts.
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if p, err := netip.ParsePrefix(e); err == nil {
+			out = append(out, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", e)
+		}
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
+}
+
+func newSourceACL(f ForwardConfig) (*sourceACL, error) {
+	allow, err := parsePrefixes(f.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	deny, err := parsePrefixes(f.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	return &sourceACL{allow: allow, deny: deny}, nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// permits reports whether a client at addr may connect, and if not, why.
+// A nil ACL permits everything.
+func (acl *sourceACL) permits(addr net.Addr) (bool, string) {
+	if acl == nil {
+		return true, ""
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false, "unknown client address"
+	}
+	ip := ap.Addr().Unmap()
+	if prefixesContain(acl.deny, ip) {
+		return false, "denied by acl"
+	}
+	if len(acl.allow) > 0 && !prefixesContain(acl.allow, ip) {
+		return false, "not in acl allow list"
+	}
+	return true, ""
+}
+
+// isLoopbackBind reports whether a listen address only accepts local
+// clients. An empty host listens on every interface.
+func isLoopbackBind(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// exposureWarnings lists the forwards of cfg that listen beyond loopback
+// without an allow or deny list.
+func exposureWarnings(cfg TunnelConfig) []string {
+	var warnings []string
+	for _, f := range cfg.Forwards {
+		if len(f.Allow) > 0 || len(f.Deny) > 0 {
+			continue
+		}
+		switch f.Type {
+		case ForwardLocal, ForwardDynamic, ForwardDNS:
+			if !isLoopbackBind(f.LocalAddr) {
+				warnings = append(warnings, fmt.Sprintf("%s listens on %s and accepts any client that can reach it", forwardLabel(f), f.LocalAddr))
+			}
+		case ForwardRemote:
+			if !isLoopbackBind(f.RemoteAddr) {
+				warnings = append(warnings, fmt.Sprintf("%s accepts any client that can reach %s on the server", forwardLabel(f), f.RemoteAddr))
+			}
+		}
+	}
+	return warnings
+}
+
+// routerExposureWarning warns when the router listens beyond loopback
+// without an allow or deny list, and is empty otherwise.
+func routerExposureWarning(cfg RouterConfig) string {
+	if cfg.ListenAddr == "" || len(cfg.Allow) > 0 || len(cfg.Deny) > 0 || isLoopbackBind(cfg.ListenAddr) {
+		return ""
+	}
+	return fmt.Sprintf("The router listens on %s and accepts any client that can reach it", cfg.ListenAddr)
+}
+
+// warnExposure tells the user after saving cfg if any of its forwards is
+// reachable from the network without an ACL.
+func warnExposure(cfg TunnelConfig, w fyne.Window) {
+	warnings := exposureWarnings(cfg)
+	if len(warnings) == 0 {
+		return
+	}
+	dialog.ShowInformation("Listener Open to the Network",
+		strings.Join(warnings, "\n")+"\n\nSet an allow or deny list to restrict which clients may connect.", w)
+}
+
+// splitList splits a comma separated dialog entry, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
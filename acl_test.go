@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestNewSourceACL(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		wantNil     bool
+		wantErr     bool
+	}{
+		{"empty lists", nil, nil, true, false},
+		{"blank entries only", []string{" "}, []string{""}, true, false},
+		{"cidr", []string{"10.0.0.0/8"}, nil, false, false},
+		{"bare address", nil, []string{"192.0.2.7"}, false, false},
+		{"ipv6", []string{"2001:db8::/32"}, nil, false, false},
+		{"bad allow", []string{"10.0.0.0/33"}, nil, false, true},
+		{"bad deny", nil, []string{"example.com"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := newSourceACL(ForwardConfig{Allow: tt.allow, Deny: tt.deny})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newSourceACL() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (acl == nil) != tt.wantNil {
+				t.Fatalf("newSourceACL() = %+v, want nil %v", acl, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestSourceACLPermits(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		client      string
+		want        bool
+		wantWhy     string
+	}{
+		{"no lists", nil, nil, "203.0.113.5:4000", true, ""},
+		{"in allow list", []string{"10.0.0.0/8"}, nil, "10.1.2.3:4000", true, ""},
+		{"outside allow list", []string{"10.0.0.0/8"}, nil, "192.168.1.1:4000", false, "not in acl allow list"},
+		{"denied", nil, []string{"192.168.1.0/24"}, "192.168.1.9:4000", false, "denied by acl"},
+		{"not denied", nil, []string{"192.168.1.0/24"}, "192.168.2.9:4000", true, ""},
+		{"deny wins over allow", []string{"10.0.0.0/8"}, []string{"10.0.0.1"}, "10.0.0.1:4000", false, "denied by acl"},
+		{"ipv4-mapped client", []string{"10.0.0.0/8"}, nil, "[::ffff:10.0.0.1]:4000", true, ""},
+		{"ipv6 client", []string{"2001:db8::/32"}, nil, "[2001:db8::1]:4000", true, ""},
+		{"ipv6 outside", []string{"2001:db8::/32"}, nil, "[2001:db9::1]:4000", false, "not in acl allow list"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := newSourceACL(ForwardConfig{Allow: tt.allow, Deny: tt.deny})
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr, err := net.ResolveTCPAddr("tcp", tt.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, why := acl.permits(addr)
+			if ok != tt.want || why != tt.wantWhy {
+				t.Errorf("permits(%s) = %v, %q, want %v, %q", tt.client, ok, why, tt.want, tt.wantWhy)
+			}
+		})
+	}
+}
+
+func TestIsLoopbackBind(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"127.8.0.1:8080", true},
+		{"[::1]:8080", true},
+		{"localhost:8080", true},
+		{"0.0.0.0:8080", false},
+		{":8080", false},
+		{"192.168.1.2:8080", false},
+		{"no-port", false},
+	}
+	for _, tt := range tests {
+		if got := isLoopbackBind(tt.addr); got != tt.want {
+			t.Errorf("isLoopbackBind(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestExposureWarnings(t *testing.T) {
+	tests := []struct {
+		name string
+		f    ForwardConfig
+		want int
+	}{
+		{"loopback local", ForwardConfig{Type: ForwardLocal, LocalAddr: "127.0.0.1:8080"}, 0},
+		{"open local", ForwardConfig{Type: ForwardLocal, LocalAddr: "0.0.0.0:8080"}, 1},
+		{"open local with acl", ForwardConfig{Type: ForwardLocal, LocalAddr: "0.0.0.0:8080", Allow: []string{"10.0.0.0/8"}}, 0},
+		{"open socks", ForwardConfig{Type: ForwardDynamic, LocalAddr: ":1080"}, 1},
+		{"open remote", ForwardConfig{Type: ForwardRemote, LocalAddr: "127.0.0.1:3000", RemoteAddr: "0.0.0.0:9000"}, 1},
+		{"loopback remote", ForwardConfig{Type: ForwardRemote, LocalAddr: "0.0.0.0:3000", RemoteAddr: "localhost:9000"}, 0},
+	}
+	for _, tt := range tests {
+		cfg := TunnelConfig{Forwards: []ForwardConfig{tt.f}}
+		if got := exposureWarnings(cfg); len(got) != tt.want {
+			t.Errorf("%s: exposureWarnings() = %q, want %d warnings", tt.name, got, tt.want)
+		}
+	}
+	if w := routerExposureWarning(RouterConfig{ListenAddr: "0.0.0.0:3128"}); w == "" {
+		t.Error("routerExposureWarning() is empty for an open router")
+	}
+	if w := routerExposureWarning(RouterConfig{ListenAddr: "0.0.0.0:3128", Deny: []string{"0.0.0.0/0"}}); w != "" {
+		t.Errorf("routerExposureWarning() = %q for a router with a deny list", w)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	if got := splitList(" a, ,b ,, c"); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("splitList() = %q, want [a b c]", got)
+	}
+	if got := splitList(""); got != nil {
+		t.Errorf("splitList(\"\") = %q, want nil", got)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	auditFileName    = "audit.jsonl"
+	auditFileMaxSize = 10 << 20
+	auditFileBackups = 10
+)
+
+// AuditRecord is one line of the connection audit log, written when a
+// forwarded connection ends.
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	TunnelID    string    `json:"tunnel_id"`
+	Tunnel      string    `json:"tunnel"`
+	ForwardType string    `json:"forward_type"`
+	Forward     string    `json:"forward"`
+	Client      string    `json:"client"`
+	Target      string    `json:"target,omitempty"`
+	DurationMs  int64     `json:"duration_ms"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	CloseReason string    `json:"close_reason"`
+}
+
+// auditLog appends AuditRecords as JSON Lines. Records are dropped until
+// openAuditLog has been called.
+type auditLog struct {
+	mu sync.Mutex
+	w  *rotatingWriter
+}
+
+var audit = &auditLog{}
+
+// openAuditLog starts writing the audit log to a rotating file in dir.
+func openAuditLog(dir string) (*rotatingWriter, error) {
+	path := filepath.Join(dir, auditFileName)
+	w, err := newRotatingWriter(path, auditFileMaxSize, auditFileBackups)
+	if err != nil {
+		return nil, err
+	}
+	audit.mu.Lock()
+	audit.w = w
+	audit.mu.Unlock()
+	slog.Info("Writing connection audit log", "path", path)
+	return w, nil
+}
+
+func (a *auditLog) write(rec AuditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("Failed to encode audit record", "err", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.w == nil {
+		return
+	}
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write audit record", "err", err)
+	}
+}
+
+// auditConn collects the audit record for one accepted connection while
+// its handler runs. Handlers set target, tc and reason as they learn them
+// and defer finish.
+type auditConn struct {
+	rt      *RunningTunnel
+	af      *activeForward
+	client  string
+	started time.Time
+	target  string
+	tc      *TrackedConn
+	reason  string
+}
+
+func (rt *RunningTunnel) newAuditConn(af *activeForward, conn net.Conn) *auditConn {
+	return &auditConn{rt: rt, af: af, client: conn.RemoteAddr().String(), started: time.Now()}
+}
+
+func (ac *auditConn) finish() {
+	rec := AuditRecord{
+		Time:        ac.started,
+		TunnelID:    ac.rt.Cfg.ID,
+		Tunnel:      ac.rt.Cfg.Name,
+		ForwardType: ac.af.cfg.Type.key(),
+		Forward:     forwardLabel(ac.af.cfg),
+		Client:      ac.client,
+		Target:      ac.target,
+		DurationMs:  time.Since(ac.started).Milliseconds(),
+		CloseReason: ac.reason,
+	}
+	if ac.tc != nil {
+		rec.BytesIn = ac.tc.BytesIn.Load()
+		rec.BytesOut = ac.tc.BytesOut.Load()
+	}
+	// A connection that ended on its own keeps its reason even if the
+	// tunnel is stopping by now
+	if rec.CloseReason == "" && ac.rt.isStopping() {
+		rec.CloseReason = "tunnel stopped"
+	}
+	audit.write(rec)
+}
+
+// closeReason describes how one direction of a piped connection ended.
+func closeReason(side string, err error) string {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return side + " closed"
+	}
+	return side + " error: " + err.Error()
+}
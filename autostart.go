@@ -0,0 +1,11 @@
+package main
+
+import "os"
+
+// autostartName names the login item on every platform.
+const autostartName = "sshtunnel-webproxy"
+
+// executablePath is the program the login item should start.
+func executablePath() (string, error) {
+	return os.Executable()
+}
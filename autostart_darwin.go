@@ -0,0 +1,55 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+)
+
+// launchAgentPath is the per-user LaunchAgent that starts this program.
+func launchAgentPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", "com.graysonlee."+autostartName+".plist"), nil
+}
+
+func setLaunchAtLogin(enabled bool) error {
+	path, err := launchAgentPath()
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	exe, err := executablePath()
+	if err != nil {
+		return err
+	}
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>com.graysonlee.%s</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%s</string>
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+</dict>
+</plist>
+`, autostartName, html.EscapeString(exe))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(plist), 0644)
+}
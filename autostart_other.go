@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "errors"
+
+func setLaunchAtLogin(enabled bool) error {
+	if !enabled {
+		return nil
+	}
+	return errors.New("launch at login is not supported on this platform")
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package main
+
+import (
+	"golang.org/x/sys/windows/registry"
+)
+
+const runKey = `Software\Microsoft\Windows\CurrentVersion\Run`
+
+func setLaunchAtLogin(enabled bool) error {
+	k, _, err := registry.CreateKey(registry.CURRENT_USER, runKey, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+	if !enabled {
+		if err := k.DeleteValue(autostartName); err != nil && err != registry.ErrNotExist {
+			return err
+		}
+		return nil
+	}
+	exe, err := executablePath()
+	if err != nil {
+		return err
+	}
+	return k.SetStringValue(autostartName, `"`+exe+`"`)
+}
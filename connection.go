@@ -6,10 +6,11 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -17,31 +18,107 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func (state *AppState) getSSHConnection(cfg TunnelConfig, twoFACode string) (*ssh.Client, error) {
-	key := fmt.Sprintf("%s@%s:%d", cfg.Auth.User, cfg.SSHHost, cfg.SSHPort)
-	log.Printf("Getting SSH connection for %s", key)
+// connectionKey identifies an SSH connection that tunnels may share.
+func connectionKey(cfg TunnelConfig) string {
+	return fmt.Sprintf("%s@%s:%d", cfg.Auth.User, cfg.SSHHost, cfg.SSHPort)
+}
 
+// hasSSHConnection reports whether cfg's server is connected, or being
+// connected to, so starting cfg needs no login of its own.
+func (state *AppState) hasSSHConnection(cfg TunnelConfig) bool {
 	state.connMu.Lock()
-	conn, exists := state.connections[key]
-	if exists {
-		log.Printf("Reusing SSH connection for %s", key)
-		conn.mu.Lock()
-		conn.refCount++
-		conn.mu.Unlock()
+	defer state.connMu.Unlock()
+	key := connectionKey(cfg)
+	_, exists := state.connections[key]
+	return exists || state.dialing[key] != nil
+}
+
+// pendingDial is a connection being opened. Tunnels that need the same
+// server meanwhile wait for it instead of dialling, and logging in, again.
+type pendingDial struct {
+	done chan struct{}
+	err  error
+}
+
+func (state *AppState) getSSHConnection(cfg TunnelConfig, twoFACode string) (*ssh.Client, error) {
+	key := connectionKey(cfg)
+	slog.Debug("Getting SSH connection", "ssh", key)
+
+	var pending *pendingDial
+	for pending == nil {
+		state.connMu.Lock()
+		if conn, exists := state.connections[key]; exists {
+			slog.Info("Reusing SSH connection", "ssh", key)
+			conn.mu.Lock()
+			conn.refCount++
+			conn.mu.Unlock()
+			state.connMu.Unlock()
+			return conn.client, nil
+		}
+		if p := state.dialing[key]; p != nil {
+			state.connMu.Unlock()
+			slog.Debug("Waiting for SSH connection in progress", "ssh", key)
+			<-p.done
+			if p.err != nil {
+				return nil, p.err
+			}
+			continue
+		}
+		if state.dialing == nil {
+			state.dialing = make(map[string]*pendingDial)
+		}
+		pending = &pendingDial{done: make(chan struct{})}
+		state.dialing[key] = pending
 		state.connMu.Unlock()
-		return conn.client, nil
 	}
-	state.connMu.Unlock()
 
-	client, err := dialSSH(cfg, twoFACode)
+	client, ep, err := dialSSH(cfg, twoFACode, state.prompter(cfg))
+
+	state.connMu.Lock()
+	delete(state.dialing, key)
+	if err == nil {
+		state.connections[key] = &sshConnection{client: client, endpoint: ep, refCount: 1}
+	}
+	pending.err = err
+	close(pending.done)
+	state.connMu.Unlock()
 	if err != nil {
 		return nil, err
 	}
+	return client, nil
+}
+
+// releaseSSHConnection drops rt's reference to its SSH connection and
+// closes the connection once no tunnel uses it.
+func (state *AppState) releaseSSHConnection(rt *RunningTunnel) {
+	client := rt.takeSSHClient()
+	if client == nil {
+		return
+	}
+	key := connectionKey(rt.Cfg)
+	defer func() {
+		if r := recover(); r != nil {
+			rt.log.Error("Panic in SSH connection cleanup", "panic", r)
+		}
+	}()
 
 	state.connMu.Lock()
-	state.connections[key] = &sshConnection{client: client, refCount: 1}
-	state.connMu.Unlock()
-	return client, nil
+	defer state.connMu.Unlock()
+
+	conn, exists := state.connections[key]
+	if !exists || conn.client != client {
+		return
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.refCount--
+	if conn.refCount > 0 {
+		rt.log.Info("Keeping shared SSH connection", "ssh", key, "refs", conn.refCount)
+		return
+	}
+	rt.log.Info("Closing SSH connection", "ssh", key)
+	delete(state.connections, key)
+	client.Close()
 }
 
 func dialViaHTTPProxy(p *ProxyConfig, targetAddr string) (net.Conn, error) {
@@ -85,23 +162,79 @@ func dialViaHTTPProxy(p *ProxyConfig, targetAddr string) (net.Conn, error) {
 	return conn, nil
 }
 
-func dialSSH(cfg TunnelConfig, twoFACode string) (*ssh.Client, error) {
-	sshAddr := fmt.Sprintf("%s:%d", cfg.SSHHost, cfg.SSHPort)
-	log.Printf("Attempting to connect to %s", sshAddr)
+// dialSSH connects and authenticates to the first reachable endpoint of
+// cfg and reports which endpoint that was.
+func dialSSH(cfg TunnelConfig, twoFACode string, prompt *loginPrompter) (*ssh.Client, SSHEndpoint, error) {
+	lg := slog.With("tunnel", cfg.ID)
+	conf, err := clientConfig(cfg, twoFACode, prompt)
+	if err != nil {
+		return nil, SSHEndpoint{}, err
+	}
+	eps := cfg.sshEndpoints()
+	var lastErr error
+	if cfg.RaceEndpoints {
+		conn, ep, err := raceEndpoints(cfg, conf.Timeout)
+		if err != nil {
+			return nil, ep, err
+		}
+		client, err := sshHandshake(cfg, conn, ep.addr(), conf)
+		if err == nil {
+			lg.Info("Successfully connected", "ssh", ep.addr())
+			return client, ep, nil
+		}
+		if isAuthError(err) {
+			return nil, ep, err
+		}
+		// The winner took the TCP connection but not the SSH session, as a
+		// server resetting after accept would; go through the others
+		lg.Warn("Raced endpoint failed, trying the others", "ssh", ep.addr(), "err", err)
+		lastErr = err
+		eps = slices.DeleteFunc(eps, func(e SSHEndpoint) bool { return e == ep })
+	}
+
+	// Try endpoints in priority order. Bad credentials fail the same way
+	// everywhere, so they end the search.
+	for _, ep := range eps {
+		conn, err := dialTransport(cfg, ep.addr(), conf.Timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		client, err := sshHandshake(cfg, conn, ep.addr(), conf)
+		if err != nil {
+			if isAuthError(err) {
+				return nil, ep, err
+			}
+			lastErr = err
+			continue
+		}
+		lg.Info("Successfully connected", "ssh", ep.addr())
+		return client, ep, nil
+	}
+	return nil, SSHEndpoint{}, lastErr
+}
+
+// clientConfig builds the SSH client settings for cfg's credentials.
+// Keyboard-interactive prompts it can't answer go to prompt, if not nil.
+// Without 2FA, keyboard-interactive is still offered after the password
+// and key, for servers such as Duo or Okta that always ask through it.
+func clientConfig(cfg TunnelConfig, twoFACode string, prompt *loginPrompter) (*ssh.ClientConfig, error) {
+	lg := slog.With("tunnel", cfg.ID)
 	auths := []ssh.AuthMethod{}
+	kbd := &kbdAuth{password: cfg.Auth.Password, code: twoFACode, prompt: prompt}
 	if cfg.Auth.Use2FA {
-		log.Printf("Using keyboard-interactive authentication (2FA enabled)")
-		auths = []ssh.AuthMethod{ssh.KeyboardInteractive(kbdChallenge(cfg.Auth.Password, twoFACode))}
+		lg.Debug("Using keyboard-interactive authentication (2FA enabled)")
+		auths = []ssh.AuthMethod{ssh.KeyboardInteractive(kbd.challenge)}
 	} else {
 		if cfg.Auth.Password != "" {
-			log.Printf("Using password authentication for user %s", cfg.Auth.User)
+			lg.Debug("Using password authentication", "user", cfg.Auth.User)
 			auths = append(auths, ssh.Password(cfg.Auth.Password))
 		}
 		if cfg.Auth.KeyPath != "" {
-			log.Printf("Using key authentication from %s", cfg.Auth.KeyPath)
+			lg.Debug("Using key authentication", "key", cfg.Auth.KeyPath)
 			pem, err := os.ReadFile(filepath.Clean(cfg.Auth.KeyPath))
 			if err != nil {
-				log.Printf("Failed to read key: %v", err)
+				lg.Error("Failed to read key", "err", err)
 				return nil, fmt.Errorf("read key: %w", err)
 			}
 			var signer ssh.Signer
@@ -111,7 +244,7 @@ func dialSSH(cfg TunnelConfig, twoFACode string) (*ssh.Client, error) {
 				signer, err = ssh.ParsePrivateKey(pem)
 			}
 			if err != nil {
-				log.Printf("Failed to parse key: %v", err)
+				lg.Error("Failed to parse key", "err", err)
 				return nil, fmt.Errorf("parse key: %w", err)
 			}
 			auths = append(auths, ssh.PublicKeys(signer))
@@ -120,54 +253,60 @@ func dialSSH(cfg TunnelConfig, twoFACode string) (*ssh.Client, error) {
 	if len(auths) == 0 {
 		return nil, fmt.Errorf("no authentication methods provided")
 	}
-	conf := &ssh.ClientConfig{
+	if !cfg.Auth.Use2FA {
+		auths = append(auths, ssh.KeyboardInteractive(kbd.challenge))
+	}
+	return &ssh.ClientConfig{
 		User:            cfg.Auth.User,
 		Auth:            auths,
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 		Timeout:         15 * time.Second,
-	}
-	var client *ssh.Client
+	}, nil
+}
+
+// dialTransport opens the TCP connection to an SSH server, through the
+// configured HTTP proxy if there is one.
+func dialTransport(cfg TunnelConfig, sshAddr string, timeout time.Duration) (net.Conn, error) {
+	lg := slog.With("tunnel", cfg.ID, "ssh", sshAddr)
 	if cfg.Proxy != nil && cfg.Proxy.Host != "" {
-		log.Printf("Dialing via HTTP proxy %s:%d", cfg.Proxy.Host, cfg.Proxy.Port)
+		lg.Info("Dialing via HTTP proxy", "proxy", net.JoinHostPort(cfg.Proxy.Host, strconv.Itoa(cfg.Proxy.Port)))
 		conn, err := dialViaHTTPProxy(cfg.Proxy, sshAddr)
 		if err != nil {
-			log.Printf("Proxy dial failed: %v", err)
-			return nil, err
-		}
-		log.Printf("Proxy connection established, performing SSH handshake")
-		c, chans, reqs, err := ssh.NewClientConn(conn, sshAddr, conf)
-		if err != nil {
-			conn.Close()
-			log.Printf("SSH handshake failed: %v", err)
-			return nil, fmt.Errorf("ssh handshake failed: %w", err)
-		}
-		client = ssh.NewClient(c, chans, reqs)
-	} else {
-		log.Printf("Direct dial to %s", sshAddr)
-		var err error
-		client, err = ssh.Dial("tcp", sshAddr, conf)
-		if err != nil {
-			log.Printf("Direct dial failed: %v", err)
+			lg.Warn("Proxy dial failed", "err", err)
 			return nil, err
 		}
+		lg.Debug("Proxy connection established, performing SSH handshake")
+		return conn, nil
 	}
-	log.Printf("Successfully connected to %s", sshAddr)
-	return client, nil
+	lg.Debug("Direct dial")
+	conn, err := net.DialTimeout("tcp", sshAddr, timeout)
+	if err != nil {
+		lg.Warn("Direct dial failed", "err", err)
+		return nil, err
+	}
+	return conn, nil
 }
 
-func kbdChallenge(password, code string) ssh.KeyboardInteractiveChallenge {
-	return func(user, instruction string, questions []string, echos []bool) (answers []string, err error) {
-		answers = make([]string, len(questions))
-		for i, q := range questions {
-			ql := strings.ToLower(strings.TrimSpace(q))
-			if strings.Contains(ql, "password") {
-				answers[i] = password
-			} else if strings.Contains(ql, "verification") || strings.Contains(ql, "code") || strings.Contains(ql, "token") || strings.Contains(ql, "authenticator") {
-				answers[i] = code
-			} else {
-				return nil, fmt.Errorf("unexpected prompt: %s", q)
-			}
-		}
-		return answers, nil
+// sshHandshake runs the SSH handshake and authentication over an
+// established connection and records how long it took.
+func sshHandshake(cfg TunnelConfig, conn net.Conn, sshAddr string, conf *ssh.ClientConfig) (*ssh.Client, error) {
+	begin := time.Now()
+	c, chans, reqs, err := ssh.NewClientConn(conn, sshAddr, conf)
+	if err != nil {
+		conn.Close()
+		slog.Error("SSH handshake failed", "tunnel", cfg.ID, "ssh", sshAddr, "err", err)
+		return nil, fmt.Errorf("ssh handshake failed: %w", err)
 	}
+	metrics.observeHandshake(cfg, time.Since(begin))
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// isAuthError reports whether err came from the server rejecting our
+// credentials rather than from the network or handshake.
+func isAuthError(err error) bool {
+	return err != nil && isAuthErrorMsg(err.Error())
+}
+
+func isAuthErrorMsg(msg string) bool {
+	return strings.Contains(msg, "unable to authenticate")
 }
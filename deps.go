@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/widget"
+)
+
+// validateDependencies checks that every depends_on entry names another
+// tunnel by ID and that the dependencies contain no cycle.
+func validateDependencies(cfgs []TunnelConfig) error {
+	byID := make(map[string]*TunnelConfig, len(cfgs))
+	for i := range cfgs {
+		if cfgs[i].ID != "" {
+			byID[cfgs[i].ID] = &cfgs[i]
+		}
+	}
+	for _, cfg := range cfgs {
+		for _, dep := range cfg.DependsOn {
+			if dep == cfg.ID {
+				return fmt.Errorf("tunnel %s depends on itself", cfg.Name)
+			}
+			if byID[dep] == nil {
+				return fmt.Errorf("tunnel %s depends on unknown tunnel %s", cfg.Name, dep)
+			}
+		}
+	}
+
+	// Depth-first search; a tunnel seen again while still on the path
+	// closes a cycle
+	const (
+		unvisited = iota
+		onPath
+		done
+	)
+	mark := make(map[string]int)
+	var path []string
+	var visit func(id string) error
+	visit = func(id string) error {
+		switch mark[id] {
+		case onPath:
+			start := 0
+			for i, p := range path {
+				if p == id {
+					start = i
+				}
+			}
+			names := []string{}
+			for _, p := range append(path[start:], id) {
+				names = append(names, byID[p].Name)
+			}
+			return fmt.Errorf("dependency cycle: %s", strings.Join(names, " -> "))
+		case done:
+			return nil
+		}
+		mark[id] = onPath
+		path = append(path, id)
+		for _, dep := range byID[id].DependsOn {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		mark[id] = done
+		return nil
+	}
+	for id := range byID {
+		if err := visit(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeDependency drops id from every tunnel's depends_on, for when that
+// tunnel is deleted.
+func removeDependency(cfgs []TunnelConfig, id string) {
+	for i := range cfgs {
+		var deps []string
+		for _, dep := range cfgs[i].DependsOn {
+			if dep != id {
+				deps = append(deps, dep)
+			}
+		}
+		cfgs[i].DependsOn = deps
+	}
+}
+
+// dependencyPicker is a check list of the tunnels another one may depend on.
+type dependencyPicker struct {
+	group *widget.CheckGroup
+	ids   map[string]string // label -> tunnel ID
+}
+
+// dependencyPicker lists every tunnel except self, with the ones in
+// selected already checked.
+func (state *AppState) dependencyPicker(self string, selected []string) *dependencyPicker {
+	p := &dependencyPicker{ids: make(map[string]string)}
+	var options, checked []string
+	for _, cfg := range state.configs {
+		if cfg.ID == self {
+			continue
+		}
+		label := tunnelLabel(cfg)
+		p.ids[label] = cfg.ID
+		options = append(options, label)
+		for _, id := range selected {
+			if id == cfg.ID {
+				checked = append(checked, label)
+			}
+		}
+	}
+	p.group = widget.NewCheckGroup(options, nil)
+	p.group.SetSelected(checked)
+	return p
+}
+
+// selected returns the IDs of the checked tunnels in list order.
+func (p *dependencyPicker) selected() []string {
+	var ids []string
+	for _, label := range p.group.Options {
+		for _, s := range p.group.Selected {
+			if s == label {
+				ids = append(ids, p.ids[label])
+			}
+		}
+	}
+	return ids
+}
+
+// tunnelLabel names a tunnel in pickers where names may repeat.
+func tunnelLabel(cfg TunnelConfig) string {
+	return cfg.Name + " (" + shortID(cfg.ID) + ")"
+}
+
+// pendingDependencies returns the dependencies of cfg that are not up
+// yet. An Idle on-demand dependency counts as up.
+func (state *AppState) pendingDependencies(cfg TunnelConfig) []string {
+	var pending []string
+	for _, dep := range cfg.DependsOn {
+		if rt, ok := state.getRunning(dep); ok && rt.Status().isUp() {
+			continue
+		}
+		pending = append(pending, dep)
+	}
+	return pending
+}
+
+// waitForDependencies blocks until every tunnel in pending is connected
+// and then connects rt on the UI goroutine. If a dependency fails or is
+// stopped first, rt goes to Error instead.
+func (state *AppState) waitForDependencies(rt *RunningTunnel, pending []string, w fyne.Window) {
+	events, unsubscribe := state.events.subscribe()
+	defer unsubscribe()
+
+	waiting := make(map[string]bool)
+	for _, dep := range pending {
+		waiting[dep] = true
+	}
+	// Subscribed first, so nothing is missed between this check and the loop
+	for dep := range waiting {
+		if d, ok := state.getRunning(dep); ok && d.Status().isUp() {
+			delete(waiting, dep)
+		}
+	}
+	for len(waiting) > 0 {
+		ev, ok := <-events
+		if !ok {
+			return
+		}
+		if ev.TunnelID == rt.Cfg.ID && ev.To != StatusConnecting {
+			return
+		}
+		if !waiting[ev.TunnelID] {
+			continue
+		}
+		switch ev.To {
+		case StatusConnected, StatusIdle:
+			delete(waiting, ev.TunnelID)
+		case StatusError, StatusStopped, StatusDisconnected:
+			// A Stopped event is also sent when a failed dependency is
+			// restarted; only give up if nothing replaced it
+			if d, ok := state.getRunning(ev.TunnelID); ok && d.Status() == StatusConnecting {
+				continue
+			}
+			msg := fmt.Sprintf("dependency %s is %s", ev.Name, strings.ToLower(ev.To.String()))
+			if ev.ErrorMsg != "" {
+				msg += ": " + ev.ErrorMsg
+			}
+			rt.transitionFrom(StatusConnecting, StatusError, msg)
+			return
+		}
+	}
+	fyne.Do(func() { state.connectTunnel(rt, w) })
+}
+
+// runningDependents returns the IDs of the running tunnels that depend on
+// id, directly or through other tunnels.
+func (state *AppState) runningDependents(id string) []string {
+	running := state.runningTunnels()
+	seen := map[string]bool{id: true}
+	var out []string
+	var visit func(id string)
+	visit = func(id string) {
+		for otherID, rt := range running {
+			if seen[otherID] || !slices.Contains(rt.Cfg.DependsOn, id) {
+				continue
+			}
+			seen[otherID] = true
+			out = append(out, otherID)
+			visit(otherID)
+		}
+	}
+	visit(id)
+	return out
+}
+
+// stopDependents stops every running tunnel that depends on id. It runs
+// from RunningTunnel.stop, so it covers every way a tunnel stops; each
+// dependent's own stop carries it further down the chain.
+func (state *AppState) stopDependents(id string) {
+	for otherID, rt := range state.runningTunnels() {
+		if !slices.Contains(rt.Cfg.DependsOn, id) {
+			continue
+		}
+		rt.log.Info("Stopping because a dependency is stopping", "dependency", id)
+		rt.stop(state)
+		state.removeRunning(otherID, rt)
+	}
+}
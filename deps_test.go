@@ -0,0 +1,74 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateDependencies(t *testing.T) {
+	tests := []struct {
+		name    string
+		deps    map[string][]string // depends_on by tunnel ID, for tunnels a, b and c
+		wantErr string
+	}{
+		{"none", nil, ""},
+		{"chain", map[string][]string{"a": {"b"}, "b": {"c"}}, ""},
+		{"shared dependency", map[string][]string{"a": {"c"}, "b": {"c"}}, ""},
+		{"self", map[string][]string{"a": {"a"}}, "depends on itself"},
+		{"unknown", map[string][]string{"a": {"x"}}, "unknown tunnel x"},
+		{"two-tunnel cycle", map[string][]string{"a": {"b"}, "b": {"a"}}, "dependency cycle"},
+		{"three-tunnel cycle", map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}}, "dependency cycle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfgs []TunnelConfig
+			for _, id := range []string{"a", "b", "c"} {
+				cfg := testTunnel(id)
+				cfg.DependsOn = tt.deps[id]
+				cfgs = append(cfgs, cfg)
+			}
+			err := validateDependencies(cfgs)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateDependencies() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateDependencies() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRemoveDependency(t *testing.T) {
+	cfgs := []TunnelConfig{testTunnel("a"), testTunnel("b")}
+	cfgs[0].DependsOn = []string{"b", "c"}
+	cfgs[1].DependsOn = []string{"c"}
+	removeDependency(cfgs, "c")
+	if !slices.Equal(cfgs[0].DependsOn, []string{"b"}) {
+		t.Errorf("a depends on %v, want [b]", cfgs[0].DependsOn)
+	}
+	if len(cfgs[1].DependsOn) != 0 {
+		t.Errorf("b depends on %v, want nothing", cfgs[1].DependsOn)
+	}
+}
+
+func TestRunningDependents(t *testing.T) {
+	state := &AppState{running: make(map[string]*RunningTunnel)}
+	// c depends on a through b
+	for id, deps := range map[string][]string{"a": nil, "b": {"a"}, "c": {"b"}} {
+		cfg := testTunnel(id)
+		cfg.DependsOn = deps
+		state.setRunning(id, newRunningTunnel(cfg, nil))
+	}
+	got := state.runningDependents("a")
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"b", "c"}) {
+		t.Errorf("runningDependents(a) = %v, want [b c]", got)
+	}
+	if got := state.runningDependents("c"); len(got) != 0 {
+		t.Errorf("runningDependents(c) = %v, want none", got)
+	}
+}
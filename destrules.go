@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// DestRule allows or denies SOCKS destinations. Host is a glob such as
+// "*.corp.example.com", CIDR an address range, and Ports a list like
+// "443" or "80,8000-8999". Empty fields match anything.
+//
+// Host names are resolved on the SSH server, so a CIDR can't tell where a
+// name leads. To fail closed, a deny rule's CIDR matches every name and an
+// allow rule's CIDR matches none.
+type DestRule struct {
+	Action string `json:"action"` // "allow" or "deny"
+	Host   string `json:"host,omitempty"`
+	CIDR   string `json:"cidr,omitempty"`
+	Ports  string `json:"ports,omitempty"`
+}
+
+type portRange struct{ lo, hi int }
+
+type compiledDestRule struct {
+	allow  bool
+	host   string
+	prefix netip.Prefix
+	ports  []portRange
+}
+
+// destRules is the compiled rule list of a forward. The first matching
+// rule decides; when none matches, the destination is allowed unless the
+// list contains allow rules.
+type destRules struct {
+	rules        []compiledDestRule
+	defaultAllow bool
+}
+
+func parsePorts(s string) ([]portRange, error) {
+	var out []portRange
+	for _, part := range splitList(s) {
+		lo, hi, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(lo))
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(strings.TrimSpace(hi))
+		}
+		if err != nil || from < 1 || to > 65535 || from > to {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		out = append(out, portRange{from, to})
+	}
+	return out, nil
+}
+
+func compileDestRules(rules []DestRule) (*destRules, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	d := &destRules{defaultAllow: true}
+	for i, r := range rules {
+		var c compiledDestRule
+		switch strings.ToLower(r.Action) {
+		case "allow":
+			c.allow = true
+			d.defaultAllow = false
+		case "deny":
+		default:
+			return nil, fmt.Errorf("destination rule %d: action must be allow or deny", i+1)
+		}
+		if r.Host != "" {
+			c.host = strings.ToLower(r.Host)
+			if _, err := path.Match(c.host, ""); err != nil {
+				return nil, fmt.Errorf("destination rule %d: invalid host pattern %q", i+1, r.Host)
+			}
+		}
+		if r.CIDR != "" {
+			p, err := parsePrefixes([]string{r.CIDR})
+			if err != nil {
+				return nil, fmt.Errorf("destination rule %d: %w", i+1, err)
+			}
+			c.prefix = p[0]
+		}
+		ports, err := parsePorts(r.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("destination rule %d: %w", i+1, err)
+		}
+		c.ports = ports
+		d.rules = append(d.rules, c)
+	}
+	return d, nil
+}
+
+func (c compiledDestRule) matches(host string, ip netip.Addr, port int) bool {
+	if c.host != "" {
+		if ok, _ := path.Match(c.host, host); !ok {
+			return false
+		}
+	}
+	if c.prefix.IsValid() {
+		if !ip.IsValid() {
+			if c.allow {
+				return false
+			}
+		} else if !c.prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(c.ports) == 0 {
+		return true
+	}
+	for _, pr := range c.ports {
+		if port >= pr.lo && port <= pr.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// permits reports whether host:port may be dialled. A nil list permits
+// everything.
+func (d *destRules) permits(host string, port int) bool {
+	if d == nil {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip, _ := netip.ParseAddr(host)
+	ip = ip.Unmap()
+	for _, r := range d.rules {
+		if r.matches(host, ip, port) {
+			return r.allow
+		}
+	}
+	return d.defaultAllow
+}
+
+// tunnelPermits reports whether the router may send host:port through a
+// tunnel. Every SOCKS forward of the tunnel that has destination rules
+// must permit it.
+func tunnelPermits(cfg TunnelConfig, host string, port int) bool {
+	for _, f := range cfg.Forwards {
+		if f.Type != ForwardDynamic || len(f.DestRules) == 0 {
+			continue
+		}
+		d, err := compileDestRules(f.DestRules)
+		if err != nil || !d.permits(host, port) {
+			return false
+		}
+	}
+	return true
+}
+
+// formatDestRules renders rules one per line as "action [host] [cidr]
+// [ports]" for the edit dialog, with "*" standing for any host.
+func formatDestRules(rules []DestRule) string {
+	lines := make([]string, len(rules))
+	for i, r := range rules {
+		target := r.Host
+		if r.CIDR != "" {
+			target = r.CIDR
+			if r.Host != "" {
+				target = r.Host + " " + r.CIDR
+			}
+		}
+		if target == "" {
+			target = "*"
+		}
+		lines[i] = strings.TrimSpace(strings.ToLower(r.Action) + " " + target + " " + r.Ports)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseDestRules reads the dialog format of formatDestRules. A field that
+// parses as a CIDR or address is the CIDR, one made of digits, commas and
+// dashes the ports, and anything else the host glob.
+func parseDestRules(s string) ([]DestRule, error) {
+	var rules []DestRule
+	for n, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		r := DestRule{Action: strings.ToLower(fields[0])}
+		for _, f := range fields[1:] {
+			var dup bool
+			if _, err := parsePrefixes([]string{f}); err == nil {
+				dup, r.CIDR = r.CIDR != "", f
+			} else if strings.Trim(f, "0123456789,-") == "" {
+				dup, r.Ports = r.Ports != "", f
+			} else if f != "*" {
+				dup, r.Host = r.Host != "", f
+			}
+			if dup {
+				return nil, fmt.Errorf("destination rule line %d: unexpected %q", n+1, f)
+			}
+		}
+		if _, err := compileDestRules([]DestRule{r}); err != nil {
+			return nil, fmt.Errorf("destination rule line %d: %w", n+1, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
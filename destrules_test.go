@@ -0,0 +1,165 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []portRange
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"443", []portRange{{443, 443}}, false},
+		{"80, 8000-8999", []portRange{{80, 80}, {8000, 8999}}, false},
+		{"1-65535", []portRange{{1, 65535}}, false},
+		{"0", nil, true},
+		{"65536", nil, true},
+		{"9000-8000", nil, true},
+		{"http", nil, true},
+		{"80-", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePorts(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePorts(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parsePorts(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDestRulesPermits(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []DestRule
+		host  string
+		port  int
+		want  bool
+	}{
+		{"no rules", nil, "anything.example.com", 22, true},
+		{"deny only, unmatched", []DestRule{{Action: "deny", Host: "*.bad.com"}}, "good.com", 443, true},
+		{"deny only, matched", []DestRule{{Action: "deny", Host: "*.bad.com"}}, "www.bad.com", 443, false},
+		{"host match ignores case and trailing dot", []DestRule{{Action: "deny", Host: "*.Bad.com"}}, "WWW.BAD.COM.", 443, false},
+		{"allow list, matched", []DestRule{{Action: "allow", Host: "*.corp.com", Ports: "443"}}, "git.corp.com", 443, true},
+		{"allow list, wrong port", []DestRule{{Action: "allow", Host: "*.corp.com", Ports: "443"}}, "git.corp.com", 22, false},
+		{"allow list, unmatched host", []DestRule{{Action: "allow", Host: "*.corp.com"}}, "example.com", 443, false},
+		{"first match wins", []DestRule{
+			{Action: "deny", Host: "secret.corp.com"},
+			{Action: "allow", Host: "*.corp.com"},
+		}, "secret.corp.com", 443, false},
+		{"cidr allow, address inside", []DestRule{{Action: "allow", CIDR: "10.0.0.0/8"}}, "10.2.3.4", 80, true},
+		{"cidr allow, address outside", []DestRule{{Action: "allow", CIDR: "10.0.0.0/8"}}, "192.168.0.1", 80, false},
+		{"cidr allow, mapped address", []DestRule{{Action: "allow", CIDR: "10.0.0.0/8"}}, "::ffff:10.2.3.4", 80, true},
+		{"cidr deny, address outside", []DestRule{{Action: "deny", CIDR: "10.0.0.0/8"}}, "192.168.0.1", 80, true},
+		// Names are resolved on the server, so CIDR rules fail closed for them
+		{"cidr allow, host name", []DestRule{{Action: "allow", CIDR: "10.0.0.0/8"}}, "intranet", 80, false},
+		{"cidr deny, host name", []DestRule{{Action: "deny", CIDR: "10.0.0.0/8"}}, "intranet", 80, false},
+		{"allow by name before cidr deny", []DestRule{
+			{Action: "allow", Host: "intranet"},
+			{Action: "deny", CIDR: "10.0.0.0/8"},
+		}, "intranet", 80, true},
+		{"cidr deny limited to ports", []DestRule{{Action: "deny", CIDR: "10.0.0.0/8", Ports: "22"}}, "10.0.0.1", 443, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := compileDestRules(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := d.permits(tt.host, tt.port); got != tt.want {
+				t.Errorf("permits(%s, %d) = %v, want %v", tt.host, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileDestRulesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule DestRule
+	}{
+		{"missing action", DestRule{Host: "*"}},
+		{"unknown action", DestRule{Action: "block"}},
+		{"bad host pattern", DestRule{Action: "deny", Host: "[a-"}},
+		{"bad cidr", DestRule{Action: "deny", CIDR: "10.0.0.0/40"}},
+		{"bad ports", DestRule{Action: "deny", Ports: "99999"}},
+	}
+	for _, tt := range tests {
+		if _, err := compileDestRules([]DestRule{tt.rule}); err == nil {
+			t.Errorf("%s: compileDestRules() succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestParseDestRules(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []DestRule
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"allow *.corp.com 443", []DestRule{{Action: "allow", Host: "*.corp.com", Ports: "443"}}, false},
+		{"DENY 10.0.0.0/8", []DestRule{{Action: "deny", CIDR: "10.0.0.0/8"}}, false},
+		{"deny * 22\n\nallow *", []DestRule{{Action: "deny", Ports: "22"}, {Action: "allow"}}, false},
+		{"deny db.corp.com 10.1.0.0/16 5432", []DestRule{{Action: "deny", Host: "db.corp.com", CIDR: "10.1.0.0/16", Ports: "5432"}}, false},
+		{"allow a.com b.com", nil, true},
+		{"allow 22 443", nil, true},
+		{"permit *", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDestRules(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDestRules(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseDestRules(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatDestRulesRoundTrip(t *testing.T) {
+	rules := []DestRule{
+		{Action: "allow", Host: "*.corp.com", Ports: "443,8443"},
+		{Action: "deny", CIDR: "10.0.0.0/8"},
+		{Action: "deny", Host: "db.corp.com", CIDR: "10.1.0.0/16", Ports: "5432"},
+		{Action: "allow"},
+	}
+	got, err := parseDestRules(formatDestRules(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, rules) {
+		t.Errorf("round trip = %+v, want %+v", got, rules)
+	}
+}
+
+func TestTunnelPermits(t *testing.T) {
+	cfg := testTunnel("a")
+	cfg.Forwards = []ForwardConfig{
+		{Type: ForwardLocal, LocalAddr: "127.0.0.1:8080", RemoteAddr: "intranet:80"},
+		{Type: ForwardDynamic, LocalAddr: "127.0.0.1:1080", DestRules: []DestRule{{Action: "allow", Host: "*.corp.com"}}},
+		{Type: ForwardDynamic, LocalAddr: "127.0.0.1:1081", DestRules: []DestRule{{Action: "deny", Host: "secret.corp.com"}}},
+	}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"git.corp.com", true},
+		{"secret.corp.com", false}, // denied by the second SOCKS forward
+		{"example.com", false},     // not allowed by the first
+	}
+	for _, tt := range tests {
+		if got := tunnelPermits(cfg, tt.host, 443); got != tt.want {
+			t.Errorf("tunnelPermits(%s) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+	if !tunnelPermits(testTunnel("b"), "example.com", 443) {
+		t.Error("a tunnel without destination rules should permit everything")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+)
+
+var connTableHeaders = []string{"Forward", "Client", "Target", "Duration", "In", "Out"}
+
+type connRow struct {
+	forward string
+	conn    *TrackedConn
+}
+
+// detailPane shows traffic statistics and open connections for the
+// tunnel selected in the list.
+type detailPane struct {
+	state    *AppState
+	title    *widget.Label
+	warning  *widget.Label
+	forwards *widget.Label
+	table    *widget.Table
+	rows     []connRow
+	ticker   *time.Ticker
+	content  fyne.CanvasObject
+}
+
+func newDetailPane(state *AppState) *detailPane {
+	p := &detailPane{state: state}
+	p.title = widget.NewLabelWithStyle("No tunnel selected", fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+	p.warning = widget.NewLabel("")
+	p.warning.Importance = widget.WarningImportance
+	p.warning.Wrapping = fyne.TextWrapWord
+	p.warning.Hide()
+	p.forwards = widget.NewLabel("")
+	p.forwards.Wrapping = fyne.TextWrapWord
+
+	p.table = widget.NewTable(
+		func() (int, int) { return len(p.rows), len(connTableHeaders) },
+		func() fyne.CanvasObject { return widget.NewLabel("") },
+		func(id widget.TableCellID, o fyne.CanvasObject) {
+			if id.Row >= len(p.rows) {
+				return
+			}
+			o.(*widget.Label).SetText(p.cell(p.rows[id.Row], id.Col))
+		},
+	)
+	p.table.ShowHeaderRow = true
+	p.table.CreateHeader = func() fyne.CanvasObject { return widget.NewLabel("") }
+	p.table.UpdateHeader = func(id widget.TableCellID, o fyne.CanvasObject) {
+		if id.Col >= 0 && id.Col < len(connTableHeaders) {
+			o.(*widget.Label).SetText(connTableHeaders[id.Col])
+		}
+	}
+	for col, width := range []float32{110, 140, 180, 80, 80, 80} {
+		p.table.SetColumnWidth(col, width)
+	}
+
+	top := container.NewVBox(p.title, p.warning, p.forwards, widget.NewLabel("Open connections:"))
+	p.content = container.NewBorder(top, nil, nil, nil, p.table)
+	return p
+}
+
+func (p *detailPane) cell(r connRow, col int) string {
+	switch col {
+	case 0:
+		return r.forward
+	case 1:
+		return r.conn.ClientAddr
+	case 2:
+		return r.conn.Target
+	case 3:
+		return time.Since(r.conn.Started).Truncate(time.Second).String()
+	case 4:
+		return formatBytes(r.conn.BytesIn.Load())
+	case 5:
+		return formatBytes(r.conn.BytesOut.Load())
+	}
+	return ""
+}
+
+// refresh re-reads the selected tunnel's counters. Must run on the UI goroutine.
+func (p *detailPane) refresh() {
+	state := p.state
+	p.rows = p.rows[:0]
+	if state.selectedIdx < 0 || state.selectedIdx >= len(state.configs) {
+		p.title.SetText("No tunnel selected")
+		p.warning.Hide()
+		p.forwards.SetText("")
+		p.table.Refresh()
+		return
+	}
+	cfg := state.configs[state.selectedIdx]
+	p.title.SetText(cfg.Name)
+	if warnings := exposureWarnings(cfg); len(warnings) > 0 {
+		p.warning.SetText("Warning: " + strings.Join(warnings, "\n"))
+		p.warning.Show()
+	} else {
+		p.warning.Hide()
+	}
+
+	rt, running := state.getRunning(cfg.ID)
+	if !running {
+		p.forwards.SetText("Not running")
+		p.table.Refresh()
+		return
+	}
+
+	var sb strings.Builder
+	var totalIn, totalOut float64
+	for i, f := range rt.Cfg.Forwards {
+		fs := rt.stats[i]
+		label := forwardLabel(f)
+		if bound := rt.boundAddr(i); bound != "" && bound != f.listenAddr() {
+			label += " (bound to " + bound + ")"
+		}
+		if e := rt.forwardErr(i); e != "" {
+			label += "\n  failed: " + e
+		}
+		rateIn, rateOut := fs.throughput()
+		totalIn += rateIn
+		totalOut += rateOut
+		blocked := ""
+		if n := fs.Blocked.Load(); n > 0 || len(f.DestRules) > 0 {
+			blocked = fmt.Sprintf(", %d blocked", n)
+		}
+		fmt.Fprintf(&sb, "%s\n  in %s, out %s, %d active, %d total, %d dial failures%s\n  up %s, down %s%s\n",
+			label, formatBytes(fs.BytesIn.Load()), formatBytes(fs.BytesOut.Load()),
+			fs.Active.Load(), fs.Total.Load(), fs.DialFailures.Load(), blocked,
+			formatRate(rateIn), formatRate(rateOut), formatLimits(f.UploadLimit, f.DownloadLimit))
+		for _, tc := range fs.connections() {
+			p.rows = append(p.rows, connRow{forward: f.LocalAddr, conn: tc})
+		}
+	}
+	fmt.Fprintf(&sb, "Tunnel: up %s, down %s%s", formatRate(totalIn), formatRate(totalOut),
+		formatLimits(rt.Cfg.UploadLimit, rt.Cfg.DownloadLimit))
+	p.forwards.SetText(sb.String())
+	p.table.Refresh()
+}
+
+// start refreshes the pane every second so live byte counts keep moving.
+func (p *detailPane) start() {
+	p.ticker = time.NewTicker(time.Second)
+	go func() {
+		for range p.ticker.C {
+			fyne.Do(p.refresh)
+		}
+	}()
+}
+
+func (p *detailPane) stop() {
+	if p.ticker != nil {
+		p.ticker.Stop()
+	}
+}
+
+func forwardLabel(f ForwardConfig) string {
+	switch f.Type {
+	case ForwardLocal:
+		return fmt.Sprintf("Local %s -> %s", f.LocalAddr, f.RemoteAddr)
+	case ForwardRemote:
+		return fmt.Sprintf("Remote %s -> %s", f.RemoteAddr, f.LocalAddr)
+	case ForwardDynamic:
+		return fmt.Sprintf("SOCKS %s", f.LocalAddr)
+	case ForwardDNS:
+		return fmt.Sprintf("DNS %s -> %s", f.LocalAddr, f.RemoteAddr)
+	default:
+		return f.Type.String()
+	}
+}
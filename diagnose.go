@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	"golang.org/x/crypto/ssh"
+)
+
+const diagTimeout = 10 * time.Second
+
+type diagLevel int
+
+const (
+	diagOK diagLevel = iota
+	diagWarn
+	diagFail
+	diagSkip
+)
+
+// diagResult is the outcome of one stage of a connection test.
+type diagResult struct {
+	stage  string
+	level  diagLevel
+	detail string
+}
+
+// diagRun walks through connecting a tunnel step by step. Once a stage
+// fails, the stages that need it are skipped.
+type diagRun struct {
+	cfg     TunnelConfig
+	prompt  *loginPrompter
+	report  func(diagResult)
+	blocked string
+}
+
+func (r *diagRun) result(stage string, level diagLevel, format string, args ...any) {
+	r.report(diagResult{stage: stage, level: level, detail: fmt.Sprintf(format, args...)})
+}
+
+// fail reports a failed stage that later stages depend on.
+func (r *diagRun) fail(stage, format string, args ...any) {
+	r.result(stage, diagFail, format, args...)
+	r.blocked = stage + " failed"
+}
+
+// skipped reports stage as skipped if an earlier stage it needs failed.
+func (r *diagRun) skipped(stage string) bool {
+	if r.blocked == "" {
+		return false
+	}
+	r.result(stage, diagSkip, "skipped, %s", r.blocked)
+	return true
+}
+
+func (r *diagRun) useProxy() bool {
+	return r.cfg.Proxy != nil && r.cfg.Proxy.Host != ""
+}
+
+// diagnose tests each step of connecting cfg's primary SSH server and
+// reports every result as soon as it is known.
+func diagnose(cfg TunnelConfig, prompt *loginPrompter, report func(diagResult)) {
+	r := &diagRun{cfg: cfg, prompt: prompt, report: report}
+	sshAddr := net.JoinHostPort(cfg.SSHHost, strconv.Itoa(cfg.SSHPort))
+	r.resolve()
+	conn := r.reach(sshAddr)
+	conn = r.proxyConnect(conn, sshAddr)
+	offered := r.handshake(conn, sshAddr)
+	r.authMethods(offered)
+	client := r.login(sshAddr)
+	if client != nil {
+		defer client.Close()
+	}
+	for i, f := range cfg.Forwards {
+		r.forward(client, i, f)
+	}
+}
+
+func lookupHost(host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), diagTimeout)
+	defer cancel()
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+// resolve looks up the SSH host, and the proxy when there is one. Behind
+// a proxy the SSH host only has to resolve on the proxy's side.
+func (r *diagRun) resolve() {
+	const stage = "DNS"
+	host := r.cfg.SSHHost
+	if !r.useProxy() {
+		addrs, err := lookupHost(host)
+		if err != nil {
+			r.fail(stage, "%v", err)
+			return
+		}
+		r.result(stage, diagOK, "%s is %s", host, strings.Join(addrs, ", "))
+		return
+	}
+	proxyHost := r.cfg.Proxy.Host
+	proxyAddrs, err := lookupHost(proxyHost)
+	if err != nil {
+		r.fail(stage, "proxy: %v", err)
+		return
+	}
+	addrs, err := lookupHost(host)
+	if err != nil {
+		r.result(stage, diagWarn, "proxy %s is %s; %s does not resolve here, so the proxy has to resolve it",
+			proxyHost, strings.Join(proxyAddrs, ", "), host)
+		return
+	}
+	r.result(stage, diagOK, "proxy %s is %s, %s is %s",
+		proxyHost, strings.Join(proxyAddrs, ", "), host, strings.Join(addrs, ", "))
+}
+
+// reach opens a TCP connection to the SSH server, or to the proxy. The
+// direct connection is kept for the handshake.
+func (r *diagRun) reach(sshAddr string) net.Conn {
+	const stage = "TCP"
+	if r.skipped(stage) {
+		return nil
+	}
+	begin := time.Now()
+	if !r.useProxy() {
+		conn, err := net.DialTimeout("tcp", sshAddr, diagTimeout)
+		if err != nil {
+			r.fail(stage, "%v", err)
+			return nil
+		}
+		r.result(stage, diagOK, "connected to %s in %s", conn.RemoteAddr(), time.Since(begin).Round(time.Millisecond))
+		return conn
+	}
+	p := r.cfg.Proxy
+	proxyAddr := net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+	var conn net.Conn
+	var err error
+	if p.TLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: diagTimeout}, "tcp", proxyAddr, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = net.DialTimeout("tcp", proxyAddr, diagTimeout)
+	}
+	if err != nil {
+		r.fail(stage, "proxy %s: %v", proxyAddr, err)
+		return nil
+	}
+	conn.Close()
+	r.result(stage, diagOK, "connected to proxy %s in %s", proxyAddr, time.Since(begin).Round(time.Millisecond))
+	return nil
+}
+
+// proxyConnect asks the proxy for a tunnel to the SSH server.
+func (r *diagRun) proxyConnect(conn net.Conn, sshAddr string) net.Conn {
+	const stage = "Proxy CONNECT"
+	if !r.useProxy() {
+		r.result(stage, diagSkip, "no proxy configured")
+		return conn
+	}
+	if r.skipped(stage) {
+		return nil
+	}
+	conn, err := dialViaHTTPProxy(r.cfg.Proxy, sshAddr)
+	if err != nil {
+		r.fail(stage, "%v", err)
+		return nil
+	}
+	r.result(stage, diagOK, "the proxy connected to %s", sshAddr)
+	return conn
+}
+
+var errProbe = errors.New("only probing")
+
+// handshake runs the key exchange and offers every auth method without
+// credentials, which tells which methods the server takes.
+func (r *diagRun) handshake(conn net.Conn, sshAddr string) (offered []string) {
+	const stage = "SSH banner and KEX"
+	if r.skipped(stage) {
+		return nil
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(diagTimeout))
+	rc := &recordingConn{Conn: conn}
+	var mu sync.Mutex
+	var hostKey ssh.PublicKey
+	probe := func(method string) {
+		mu.Lock()
+		offered = append(offered, method)
+		mu.Unlock()
+	}
+	conf := &ssh.ClientConfig{
+		User: r.cfg.Auth.User,
+		Auth: []ssh.AuthMethod{
+			ssh.PasswordCallback(func() (string, error) {
+				probe("password")
+				return "", errProbe
+			}),
+			ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				probe("publickey")
+				return nil, errProbe
+			}),
+			ssh.KeyboardInteractive(func(string, string, []string, []bool) ([]string, error) {
+				probe("keyboard-interactive")
+				return nil, errProbe
+			}),
+		},
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			mu.Lock()
+			hostKey = key
+			mu.Unlock()
+			return nil
+		},
+	}
+	c, chans, reqs, err := ssh.NewClientConn(rc, sshAddr, conf)
+	if err == nil {
+		ssh.NewClient(c, chans, reqs).Close()
+		offered = []string{"none"}
+	}
+	version, kex := rc.serverHello()
+	mu.Lock()
+	defer mu.Unlock()
+	if hostKey == nil {
+		if version != "" {
+			r.fail(stage, "%s: %v", version, err)
+		} else {
+			r.fail(stage, "%v", err)
+		}
+		return nil
+	}
+	r.result(stage, diagOK, "%s, key exchange %s, host key %s %s", version, negotiatedKex(kex),
+		hostKey.Type(), ssh.FingerprintSHA256(hostKey))
+	return slices.Clone(offered)
+}
+
+// negotiatedKex picks the key exchange the client settles on: its first
+// preference the server also offers.
+func negotiatedKex(server []string) string {
+	for _, k := range ssh.SupportedAlgorithms().KeyExchanges {
+		if slices.Contains(server, k) {
+			return k
+		}
+	}
+	return "unknown"
+}
+
+// authMethods compares what the server offers with what the tunnel uses.
+func (r *diagRun) authMethods(offered []string) {
+	const stage = "Auth methods"
+	if r.skipped(stage) {
+		return
+	}
+	if slices.Contains(offered, "none") {
+		r.result(stage, diagWarn, "the server lets %s in without authentication", r.cfg.Auth.User)
+		return
+	}
+	var uses []string
+	switch {
+	case r.cfg.Auth.Use2FA:
+		uses = []string{"keyboard-interactive"}
+	default:
+		if r.cfg.Auth.Password != "" {
+			uses = append(uses, "password")
+		}
+		if r.cfg.Auth.KeyPath != "" {
+			uses = append(uses, "publickey")
+		}
+		if len(uses) > 0 {
+			uses = append(uses, "keyboard-interactive")
+		}
+	}
+	if len(offered) == 0 {
+		r.fail(stage, "the server offers none of password, publickey or keyboard-interactive")
+		return
+	}
+	if len(uses) == 0 {
+		r.fail(stage, "the server offers %s; no password, key or 2FA is set", strings.Join(offered, ", "))
+		return
+	}
+	for _, m := range uses {
+		if slices.Contains(offered, m) {
+			r.result(stage, diagOK, "the server offers %s; this tunnel uses %s", strings.Join(offered, ", "), strings.Join(uses, ", "))
+			return
+		}
+	}
+	r.fail(stage, "the server offers %s but this tunnel uses %s", strings.Join(offered, ", "), strings.Join(uses, ", "))
+}
+
+// login authenticates with the tunnel's credentials so forwards can be
+// tried from the server.
+func (r *diagRun) login(sshAddr string) *ssh.Client {
+	const stage = "Login"
+	if r.skipped(stage) {
+		return nil
+	}
+	// 2FA codes and other prompts are asked for as the server sends them
+	conf, err := clientConfig(r.cfg, "", r.prompt)
+	if err != nil {
+		r.fail(stage, "%v", err)
+		return nil
+	}
+	conn, err := dialTransport(r.cfg, sshAddr, diagTimeout)
+	if err != nil {
+		r.fail(stage, "%v", err)
+		return nil
+	}
+	if !r.cfg.Auth.Use2FA {
+		_ = conn.SetDeadline(time.Now().Add(diagTimeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, sshAddr, conf)
+	if err != nil {
+		conn.Close()
+		r.fail(stage, "%v", err)
+		return nil
+	}
+	_ = conn.SetDeadline(time.Time{})
+	r.result(stage, diagOK, "logged in as %s", r.cfg.Auth.User)
+	return ssh.NewClient(c, chans, reqs)
+}
+
+// forward checks that the server can reach, or listen on, a forward's
+// remote side.
+func (r *diagRun) forward(client *ssh.Client, i int, f ForwardConfig) {
+	stage := fmt.Sprintf("Forward %d (%s)", i+1, forwardLabel(f))
+	if r.skipped(stage) {
+		return
+	}
+	begin := time.Now()
+	switch f.Type {
+	case ForwardDynamic:
+		r.result(stage, diagSkip, "SOCKS destinations are chosen by each client")
+	case ForwardRemote:
+		ln, err := listenRemote(client, f.RemoteAddr)
+		if err != nil {
+			r.result(stage, diagFail, "%v", err)
+			return
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+		r.result(stage, diagOK, "the server can listen on %s", addr)
+	default:
+		conn, err := dialThrough(client, f.RemoteAddr, diagTimeout)
+		if err != nil {
+			r.result(stage, diagFail, "the server cannot reach %s: %v", f.RemoteAddr, err)
+			return
+		}
+		conn.Close()
+		r.result(stage, diagOK, "the server reached %s in %s", f.RemoteAddr, time.Since(begin).Round(time.Millisecond))
+	}
+}
+
+// dialThrough dials addr from the server, giving up after timeout.
+func dialThrough(client *ssh.Client, addr string, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	safeGo(func() {
+		conn, err := client.Dial("tcp", addr)
+		done <- result{conn, err}
+	})
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		safeGo(func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		})
+		return nil, fmt.Errorf("no answer after %s", timeout)
+	}
+}
+
+// recordingConn keeps the start of what the server sends, so its version
+// line and key exchange offer can be read back.
+type recordingConn struct {
+	net.Conn
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	if c.buf.Len() < 64<<10 {
+		c.buf.Write(p[:n])
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// serverHello returns the server's version line and the key exchange
+// methods of its first KEXINIT, which is sent in the clear.
+func (c *recordingConn) serverHello() (version string, kex []string) {
+	c.mu.Lock()
+	data := bytes.Clone(c.buf.Bytes())
+	c.mu.Unlock()
+	// Servers may send other lines before the version
+	for version == "" {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		if !found {
+			return "", nil
+		}
+		data = rest
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			version = strings.TrimSpace(string(line))
+		}
+	}
+	// uint32 length, byte padding, byte SSH_MSG_KEXINIT, 16 byte cookie,
+	// then the kex name-list
+	const kexInit = 20
+	if len(data) < 26 || data[5] != kexInit {
+		return version, nil
+	}
+	list := data[22:]
+	n := binary.BigEndian.Uint32(list)
+	if uint64(n) > uint64(len(list)-4) {
+		return version, nil
+	}
+	for _, name := range strings.Split(string(list[4:4+n]), ",") {
+		// Drop the extension markers servers put in the list
+		if !strings.HasPrefix(name, "ext-info-") && !strings.HasPrefix(name, "kex-strict-") {
+			kex = append(kex, name)
+		}
+	}
+	return version, kex
+}
+
+// showDiagnostics runs a connection test for cfg and lists the result of
+// each stage as it comes in.
+func (state *AppState) showDiagnostics(cfg TunnelConfig, w fyne.Window) {
+	rows := container.NewVBox()
+	progress := widget.NewProgressBarInfinite()
+	content := container.NewBorder(progress, nil, nil, nil, container.NewVScroll(rows))
+	title := "Test Connection"
+	if cfg.Name != "" {
+		title += ": " + cfg.Name
+	}
+	d := dialog.NewCustom(title, "Close", content, w)
+	d.Resize(fyne.NewSize(600, 420))
+	d.Show()
+	safeGo(func() {
+		diagnose(cfg, state.prompter(cfg), func(res diagResult) {
+			fyne.Do(func() { rows.Add(diagRow(res)) })
+		})
+		fyne.Do(func() {
+			progress.Stop()
+			progress.Hide()
+		})
+	})
+}
+
+func diagRow(res diagResult) fyne.CanvasObject {
+	var icon fyne.Resource
+	switch res.level {
+	case diagOK:
+		icon = theme.ConfirmIcon()
+	case diagWarn:
+		icon = theme.WarningIcon()
+	case diagFail:
+		icon = theme.ErrorIcon()
+	default:
+		icon = theme.InfoIcon()
+	}
+	lbl := widget.NewLabel(res.stage + ": " + res.detail)
+	lbl.Wrapping = fyne.TextWrapWord
+	return container.NewBorder(nil, nil, widget.NewIcon(icon), nil, lbl)
+}
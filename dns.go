@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTimeout     = 5 * time.Second
+	dnsCacheSize   = 1024
+	dnsMaxTTL      = 5 * time.Minute
+	dnsNegativeTTL = 30 * time.Second
+	dnsUDPSize     = 512 // without EDNS
+)
+
+// dnsCacheKey identifies a question; names are compared lowercase.
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	msg     []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache keeps recent answers until their smallest TTL runs out.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[dnsCacheKey]dnsCacheEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[dnsCacheKey]dnsCacheEntry)}
+}
+
+// get returns a cached response for q with the given ID and the TTLs
+// reduced by the time it has been cached.
+func (c *dnsCache) get(key dnsCacheKey, id uint16) []byte {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(e.msg); err != nil {
+		return nil
+	}
+	m.ID = id
+	age := uint32(time.Since(e.stored).Seconds())
+	for _, rrs := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range rrs {
+			if rrs[i].Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			rrs[i].Header.TTL -= min(age, rrs[i].Header.TTL)
+		}
+	}
+	out, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// put caches a successful or NXDOMAIN response.
+func (c *dnsCache) put(key dnsCacheKey, msg []byte) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || h.Truncated {
+		return
+	}
+	var ttl time.Duration
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+		if err := p.SkipAllQuestions(); err != nil {
+			return
+		}
+		answers, err := p.AllAnswers()
+		if err != nil {
+			return
+		}
+		if len(answers) == 0 {
+			ttl = dnsNegativeTTL
+			break
+		}
+		ttl = dnsMaxTTL
+		for _, a := range answers {
+			ttl = min(ttl, time.Duration(a.Header.TTL)*time.Second)
+		}
+	case dnsmessage.RCodeNameError:
+		ttl = dnsNegativeTTL
+	default:
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= dnsCacheSize {
+		// Drop expired entries, or any one entry if none have expired
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < dnsCacheSize {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = dnsCacheEntry{msg: append([]byte(nil), msg...), stored: now, expires: now.Add(ttl)}
+}
+
+// dnsForwarder answers queries for a DNS forward. Names under one of
+// domains, or every name when domains is empty, are sent to the forward's
+// server over the tunnel; others go to fallback directly or are refused.
+type dnsForwarder struct {
+	rt       *RunningTunnel
+	af       *activeForward
+	server   string
+	domains  []string
+	fallback string
+	cache    *dnsCache
+}
+
+func (rt *RunningTunnel) newDNSForwarder(af *activeForward) *dnsForwarder {
+	var domains []string
+	for _, d := range af.cfg.DNSDomains {
+		if d = strings.ToLower(strings.Trim(strings.TrimSpace(d), ".")); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return &dnsForwarder{
+		rt:       rt,
+		af:       af,
+		server:   af.cfg.RemoteAddr,
+		domains:  domains,
+		fallback: af.cfg.DNSFallback,
+		cache:    newDNSCache(),
+	}
+}
+
+// viaTunnel reports whether name is resolved by the server behind the
+// tunnel.
+func (d *dnsForwarder) viaTunnel(name string) bool {
+	if len(d.domains) == 0 {
+		return true
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, dom := range d.domains {
+		if name == dom || strings.HasSuffix(name, "."+dom) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve answers one query message.
+func (d *dnsForwarder) resolve(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, fmt.Errorf("invalid question: %w", err)
+	}
+	key := dnsCacheKey{strings.ToLower(q.Name.String()), q.Type, q.Class}
+	if cached := d.cache.get(key, h.ID); cached != nil {
+		return cached, nil
+	}
+
+	var resp []byte
+	switch {
+	case d.viaTunnel(q.Name.String()):
+		resp, err = d.exchangeTunnel(query)
+	case d.fallback != "":
+		resp, err = exchangeDirect(d.fallback, query)
+	default:
+		return dnsReply(h, q, dnsmessage.RCodeRefused), nil
+	}
+	if err != nil {
+		d.af.stats.DialFailures.Add(1)
+		d.af.log.Warn("DNS query failed", "name", q.Name.String(), "type", q.Type, "err", err)
+		return dnsReply(h, q, dnsmessage.RCodeServerFailure), nil
+	}
+	d.cache.put(key, resp)
+	return resp, nil
+}
+
+// exchangeTunnel sends a query to the server over TCP through the SSH
+// connection.
+func (d *dnsForwarder) exchangeTunnel(query []byte) ([]byte, error) {
+	client, err := d.rt.acquireClient()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial("tcp", d.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// SSH channels have no deadlines
+	timer := time.AfterFunc(dnsTimeout, func() { conn.Close() })
+	defer timer.Stop()
+	if err := writeDNSTCP(conn, query); err != nil {
+		return nil, err
+	}
+	return readDNSTCP(conn)
+}
+
+// exchangeDirect sends a query to server over UDP, and again over TCP if
+// the answer came back truncated, so TCP clients get the whole answer.
+func exchangeDirect(server string, query []byte) ([]byte, error) {
+	resp, err := exchangeUDP(server, query)
+	if err != nil || !isTruncated(resp) {
+		return resp, err
+	}
+	return exchangeTCP(server, query)
+}
+
+func exchangeUDP(server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func exchangeTCP(server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if err := writeDNSTCP(conn, query); err != nil {
+		return nil, err
+	}
+	return readDNSTCP(conn)
+}
+
+// isTruncated reports whether resp has the TC bit set.
+func isTruncated(resp []byte) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	return err == nil && h.Truncated
+}
+
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	if len(msg) > 65535 {
+		return errors.New("DNS message too long")
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// dnsReply builds an answerless response to the question with rcode.
+func dnsReply(h dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	_ = b.StartQuestions()
+	_ = b.Question(q)
+	msg, _ := b.Finish()
+	return msg
+}
+
+// udpLimit is the largest UDP response the client accepts, from its EDNS
+// record if it sent one.
+func udpLimit(query []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return dnsUDPSize
+	}
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return dnsUDPSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return dnsUDPSize
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			return max(dnsUDPSize, int(h.Class))
+		}
+		if p.SkipAdditional() != nil {
+			return dnsUDPSize
+		}
+	}
+}
+
+// truncate returns the header and question of resp with the TC bit set,
+// telling the client to retry over TCP.
+func truncate(resp []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return resp
+	}
+	q, err := p.Question()
+	if err != nil {
+		return resp
+	}
+	h.Truncated = true
+	b := dnsmessage.NewBuilder(nil, h)
+	_ = b.StartQuestions()
+	_ = b.Question(q)
+	msg, err := b.Finish()
+	if err != nil {
+		return resp
+	}
+	return msg
+}
+
+// dnsUDPLoop serves queries arriving on pc until the tunnel stops.
+func (rt *RunningTunnel) dnsUDPLoop(pc net.PacketConn, stopped <-chan struct{}, d *dnsForwarder) {
+	defer rt.wg.Done()
+	af := d.af
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+			if rt.isStopping() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			af.log.Warn("DNS read error", "err", err)
+			continue
+		}
+		if ok, why := af.acl.permits(addr); !ok {
+			af.log.Warn("DNS query rejected", "remote", addr.String(), "reason", why)
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		safeGo(func() {
+			// Counted as active so an on-demand tunnel doesn't go idle
+			// while the query is in flight
+			af.stats.Active.Add(1)
+			defer af.stats.Active.Add(-1)
+			af.stats.Total.Add(1)
+			af.stats.BytesIn.Add(int64(len(query)))
+			resp, err := d.resolve(query)
+			if err != nil {
+				af.log.Debug("Dropping DNS query", "remote", addr.String(), "err", err)
+				return
+			}
+			if len(resp) > udpLimit(query) {
+				resp = truncate(resp)
+			}
+			if _, err := pc.WriteTo(resp, addr); err == nil {
+				af.stats.BytesOut.Add(int64(len(resp)))
+			}
+		})
+	}
+}
+
+// handleDNSTCP serves DNS-over-TCP queries on one client connection.
+func (rt *RunningTunnel) handleDNSTCP(conn net.Conn, af *activeForward, d *dnsForwarder) {
+	defer conn.Close()
+	ac := rt.newAuditConn(af, conn)
+	defer ac.finish()
+	ac.target = d.server
+	tc := af.stats.open(conn.RemoteAddr().String(), d.server)
+	defer af.stats.close(tc)
+	ac.tc = tc
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		query, err := readDNSTCP(conn)
+		if err != nil {
+			ac.reason = closeReason("client", err)
+			return
+		}
+		tc.BytesIn.Add(int64(len(query)))
+		af.stats.BytesIn.Add(int64(len(query)))
+		resp, err := d.resolve(query)
+		if err != nil {
+			ac.reason = err.Error()
+			return
+		}
+		if err := writeDNSTCP(conn, resp); err != nil {
+			ac.reason = closeReason("client", err)
+			return
+		}
+		tc.BytesOut.Add(int64(len(resp)))
+		af.stats.BytesOut.Add(int64(len(resp)))
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testQuestion = dnsmessage.Question{
+	Name:  dnsmessage.MustNewName("intranet.corp."),
+	Type:  dnsmessage.TypeA,
+	Class: dnsmessage.ClassINET,
+}
+
+// testResponse packs a response to testQuestion with one A answer per TTL.
+func testResponse(t *testing.T, rcode dnsmessage.RCode, ttls ...uint32) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, Response: true, RCode: rcode},
+		Questions: []dnsmessage.Question{testQuestion},
+	}
+	for _, ttl := range ttls {
+		m.Answers = append(m.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+		})
+	}
+	msg, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// testQuery packs a query for testQuestion, with an EDNS record advertising
+// udpSize when it is non-zero.
+func testQuery(t *testing.T, udpSize uint16) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{testQuestion},
+	}
+	if udpSize != 0 {
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(int(udpSize), dnsmessage.RCodeSuccess, false); err != nil {
+			t.Fatal(err)
+		}
+		m.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	}
+	msg, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDNSCachePut(t *testing.T) {
+	truncated := testResponse(t, dnsmessage.RCodeSuccess, 60)
+	truncated[2] |= 0x02 // TC bit
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		wantTTL time.Duration // zero when the response isn't cached
+	}{
+		{"smallest answer ttl", testResponse(t, dnsmessage.RCodeSuccess, 120, 60), time.Minute},
+		{"capped at the maximum", testResponse(t, dnsmessage.RCodeSuccess, 86400), dnsMaxTTL},
+		{"no answers", testResponse(t, dnsmessage.RCodeSuccess), dnsNegativeTTL},
+		{"name error", testResponse(t, dnsmessage.RCodeNameError), dnsNegativeTTL},
+		{"zero ttl", testResponse(t, dnsmessage.RCodeSuccess, 0), 0},
+		{"server failure", testResponse(t, dnsmessage.RCodeServerFailure, 60), 0},
+		{"truncated", truncated, 0},
+		{"garbage", []byte{1, 2, 3}, 0},
+	}
+	key := dnsCacheKey{name: "intranet.corp.", qtype: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newDNSCache()
+			c.put(key, tt.msg)
+			e, ok := c.entries[key]
+			if ok != (tt.wantTTL > 0) {
+				t.Fatalf("cached = %v, want %v", ok, tt.wantTTL > 0)
+			}
+			if ok && e.expires.Sub(e.stored) != tt.wantTTL {
+				t.Errorf("cached for %v, want %v", e.expires.Sub(e.stored), tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestDNSCacheGet(t *testing.T) {
+	key := dnsCacheKey{name: "intranet.corp.", qtype: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+	c := newDNSCache()
+	if got := c.get(key, 7); got != nil {
+		t.Fatal("get() on an empty cache returned a response")
+	}
+
+	c.put(key, testResponse(t, dnsmessage.RCodeSuccess, 100, 30))
+	e := c.entries[key]
+	e.stored = e.stored.Add(-20 * time.Second)
+	c.entries[key] = e
+
+	var m dnsmessage.Message
+	if err := m.Unpack(c.get(key, 7)); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 7 {
+		t.Errorf("ID = %d, want the query's ID 7", m.ID)
+	}
+	if len(m.Answers) != 2 || m.Answers[0].Header.TTL != 80 || m.Answers[1].Header.TTL != 10 {
+		t.Errorf("answers = %+v, want TTLs reduced by 20s to 80 and 10", m.Answers)
+	}
+
+	e.expires = time.Now().Add(-time.Second)
+	c.entries[key] = e
+	if got := c.get(key, 7); got != nil {
+		t.Error("get() returned an expired response")
+	}
+	if _, ok := c.entries[key]; ok {
+		t.Error("expired entry was not removed")
+	}
+}
+
+func TestUDPLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		query []byte
+		want  int
+	}{
+		{"no edns", testQuery(t, 0), dnsUDPSize},
+		{"edns 4096", testQuery(t, 4096), 4096},
+		{"edns below 512", testQuery(t, 256), dnsUDPSize},
+		{"garbage", []byte{0, 1}, dnsUDPSize},
+	}
+	for _, tt := range tests {
+		if got := udpLimit(tt.query); got != tt.want {
+			t.Errorf("%s: udpLimit() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	resp := testResponse(t, dnsmessage.RCodeSuccess, 60, 60, 60)
+	if isTruncated(resp) {
+		t.Fatal("isTruncated() is true for a full response")
+	}
+	out := truncate(resp)
+	if !isTruncated(out) {
+		t.Fatal("truncate() did not set the TC bit")
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(out); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 1 || len(m.Questions) != 1 || m.Questions[0] != testQuestion || len(m.Answers) != 0 {
+		t.Errorf("truncate() = %+v, want the header and question only", m)
+	}
+	if got := truncate([]byte{1, 2}); !bytes.Equal(got, []byte{1, 2}) {
+		t.Errorf("truncate() of garbage = %v, want it unchanged", got)
+	}
+	if isTruncated([]byte{1, 2}) {
+		t.Error("isTruncated() is true for garbage")
+	}
+}
+
+func TestDNSTCPFraming(t *testing.T) {
+	var buf bytes.Buffer
+	msg := testResponse(t, dnsmessage.RCodeSuccess, 60)
+	if err := writeDNSTCP(&buf, msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.Bytes()[:2]; got[0] != 0 || int(got[1]) != len(msg) {
+		t.Errorf("length prefix = %v, want %d", got, len(msg))
+	}
+	got, err := readDNSTCP(&buf)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("readDNSTCP() = %v, %v, want the written message", got, err)
+	}
+	if err := writeDNSTCP(&buf, make([]byte, 65536)); err == nil {
+		t.Error("writeDNSTCP() accepted a message over 65535 bytes")
+	}
+	if _, err := readDNSTCP(bytes.NewReader([]byte{0, 10, 1, 2})); err == nil {
+		t.Error("readDNSTCP() accepted a short message")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+)
+
+const (
+	// raceDelay staggers the dials when endpoints are raced, so the
+	// preferred host wins if it answers promptly
+	raceDelay = 300 * time.Millisecond
+	// failbackInterval is how often a failed-over tunnel probes the hosts
+	// it prefers
+	failbackInterval = 30 * time.Second
+)
+
+// SSHEndpoint is an additional SSH server for a tunnel. Lower priorities
+// are tried first; ssh_host/ssh_port has priority 0.
+type SSHEndpoint struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+func (e SSHEndpoint) addr() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// sshEndpoints lists the main server and any backups, most preferred first.
+func (cfg TunnelConfig) sshEndpoints() []SSHEndpoint {
+	eps := append([]SSHEndpoint{{Host: cfg.SSHHost, Port: cfg.SSHPort}}, cfg.Endpoints...)
+	sort.SliceStable(eps, func(i, j int) bool { return eps[i].Priority < eps[j].Priority })
+	return eps
+}
+
+// formatEndpoints renders backup endpoints for the edit dialog, in
+// priority order.
+func formatEndpoints(eps []SSHEndpoint) string {
+	sorted := append([]SSHEndpoint(nil), eps...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+	addrs := make([]string, len(sorted))
+	for i, ep := range sorted {
+		addrs[i] = ep.addr()
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// parseEndpoints reads a comma separated list of host[:port] backups.
+// They are tried in the order given, after ssh_host.
+func parseEndpoints(s string) ([]SSHEndpoint, error) {
+	var eps []SSHEndpoint
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(part)
+		if err != nil {
+			host, portStr = part, "22"
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid backup server %q", part)
+		}
+		eps = append(eps, SSHEndpoint{Host: host, Port: port, Priority: len(eps) + 1})
+	}
+	return eps, nil
+}
+
+// raceEndpoints dials every endpoint, starting each raceDelay after the
+// previous one, and returns the first connection to succeed.
+func raceEndpoints(cfg TunnelConfig, timeout time.Duration) (net.Conn, SSHEndpoint, error) {
+	type result struct {
+		conn net.Conn
+		ep   SSHEndpoint
+		err  error
+	}
+	eps := cfg.sshEndpoints()
+	results := make(chan result, len(eps))
+	done := make(chan struct{})
+	defer close(done)
+	for i, ep := range eps {
+		safeGo(func() {
+			select {
+			case <-time.After(time.Duration(i) * raceDelay):
+			case <-done:
+				results <- result{ep: ep, err: errors.New("race already won")}
+				return
+			}
+			conn, err := dialTransport(cfg, ep.addr(), timeout)
+			results <- result{conn, ep, err}
+		})
+	}
+
+	var lastErr error
+	for n := range eps {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		// Close whatever the slower dials still connect
+		rest := len(eps) - n - 1
+		safeGo(func() {
+			for ; rest > 0; rest-- {
+				if late := <-results; late.conn != nil {
+					late.conn.Close()
+				}
+			}
+		})
+		return r.conn, r.ep, nil
+	}
+	return nil, SSHEndpoint{}, lastErr
+}
+
+// sshEndpoint returns the endpoint the shared connection for cfg is on.
+func (state *AppState) sshEndpoint(cfg TunnelConfig) (SSHEndpoint, bool) {
+	state.connMu.Lock()
+	defer state.connMu.Unlock()
+	conn, ok := state.connections[connectionKey(cfg)]
+	if !ok {
+		return SSHEndpoint{}, false
+	}
+	return conn.endpoint, true
+}
+
+// failedOver reports whether cfg's connection is on a less preferred
+// endpoint than its first one.
+func (state *AppState) failedOver(cfg TunnelConfig) bool {
+	if len(cfg.Endpoints) == 0 {
+		return false
+	}
+	ep, ok := state.sshEndpoint(cfg)
+	return ok && ep != cfg.sshEndpoints()[0]
+}
+
+// startFailbackMonitor runs checkFailback every failbackInterval on its
+// own goroutine, so slow probes don't hold up the health checks.
+func (state *AppState) startFailbackMonitor() {
+	state.failbackTicker = time.NewTicker(failbackInterval)
+	safeGo(func() {
+		for range state.failbackTicker.C {
+			state.checkFailback()
+		}
+	})
+}
+
+// checkFailback probes the preferred endpoints of failed-over tunnels and
+// reconnects a tunnel when a better one answers. Tunnels with open client
+// connections or a 2FA prompt are left alone.
+func (state *AppState) checkFailback() {
+	reconnected := make(map[string]bool)
+	for _, rt := range state.runningTunnels() {
+		if rt.Status() != StatusConnected || !state.failedOver(rt.Cfg) || rt.Cfg.Auth.Use2FA {
+			continue
+		}
+		// One reconnect covers every tunnel on the connection
+		if reconnected[connectionKey(rt.Cfg)] {
+			continue
+		}
+		if state.sharedConnectionBusy(rt.Cfg) {
+			continue
+		}
+		current, _ := state.sshEndpoint(rt.Cfg)
+		for _, ep := range rt.Cfg.sshEndpoints() {
+			if ep == current {
+				break
+			}
+			conn, err := dialTransport(rt.Cfg, ep.addr(), 5*time.Second)
+			if err != nil {
+				continue
+			}
+			conn.Close()
+			rt.log.Info("Preferred SSH endpoint reachable again, failing back", "from", current.addr(), "to", ep.addr())
+			reconnected[connectionKey(rt.Cfg)] = true
+			state.reconnectShared(rt)
+			break
+		}
+	}
+}
+
+// sharedConnectionBusy reports whether any running tunnel on cfg's SSH
+// connection has open client connections.
+func (state *AppState) sharedConnectionBusy(cfg TunnelConfig) bool {
+	key := connectionKey(cfg)
+	for _, rt := range state.runningTunnels() {
+		if connectionKey(rt.Cfg) == key && rt.activeConnections() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// reconnectShared restarts rt and every other running tunnel sharing its
+// SSH connection, so the connection is closed and dialled afresh.
+func (state *AppState) reconnectShared(rt *RunningTunnel) {
+	key := connectionKey(rt.Cfg)
+	var ids []string
+	for otherID, other := range state.runningTunnels() {
+		if connectionKey(other.Cfg) == key {
+			ids = append(ids, otherID)
+		}
+	}
+	// Dependents are stopped along with the tunnels; bring them back too
+	for _, id := range slices.Clone(ids) {
+		for _, dep := range state.runningDependents(id) {
+			if !slices.Contains(ids, dep) {
+				ids = append(ids, dep)
+			}
+		}
+	}
+	for _, id := range ids {
+		if other, ok := state.getRunning(id); ok {
+			other.stop(state)
+			state.removeRunning(id, other)
+		}
+	}
+	fyne.Do(func() {
+		for _, id := range ids {
+			state.startTunnel(id, state.window)
+		}
+	})
+	slog.Debug("Restarted tunnels sharing connection", "ssh", key, "count", len(ids))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseEndpoints(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []SSHEndpoint
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"backup.example.com", []SSHEndpoint{{"backup.example.com", 22, 1}}, false},
+		{"b1:2222, b2 ,, [2001:db8::1]:22", []SSHEndpoint{
+			{"b1", 2222, 1},
+			{"b2", 22, 2},
+			{"2001:db8::1", 22, 3},
+		}, false},
+		{"b1:0", nil, true},
+		{"b1:ssh", nil, true},
+		{"b1:70000", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseEndpoints(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseEndpoints(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseEndpoints(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSSHEndpoints(t *testing.T) {
+	cfg := testTunnel("a")
+	cfg.Endpoints = []SSHEndpoint{
+		{Host: "late", Port: 22, Priority: 5},
+		{Host: "early", Port: 22, Priority: -1},
+		{Host: "tied", Port: 2222},
+	}
+	var got []string
+	for _, ep := range cfg.sshEndpoints() {
+		got = append(got, ep.addr())
+	}
+	// The main server keeps its place ahead of a backup of equal priority
+	want := []string{"early:22", "ssh.example.com:22", "tied:2222", "late:22"}
+	if !slices.Equal(got, want) {
+		t.Errorf("sshEndpoints() = %v, want %v", got, want)
+	}
+	if got := formatEndpoints(cfg.Endpoints); got != "early:22, tied:2222, late:22" {
+		t.Errorf("formatEndpoints() = %q", got)
+	}
+
+	eps, err := parseEndpoints(formatEndpoints(cfg.Endpoints))
+	if err != nil || len(eps) != 3 || eps[0].Host != "early" || eps[2].Priority != 3 {
+		t.Errorf("parseEndpoints(formatEndpoints()) = %+v, %v", eps, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import "fmt"
+
+// Start policies: with "all" (the default) a tunnel only runs when every
+// forward is up; with "best_effort" it runs while at least one is.
+const (
+	startAll        = "all"
+	startBestEffort = "best_effort"
+)
+
+func (cfg TunnelConfig) bestEffort() bool {
+	return cfg.StartPolicy == startBestEffort
+}
+
+// startPolicy maps the dialog checkbox to a start_policy value.
+func startPolicy(bestEffort bool) string {
+	if bestEffort {
+		return startBestEffort
+	}
+	return ""
+}
+
+// setForwardErr records why forward i is down.
+func (rt *RunningTunnel) setForwardErr(i int, err error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.forwardErrs == nil {
+		rt.forwardErrs = make([]string, len(rt.Cfg.Forwards))
+	}
+	rt.forwardErrs[i] = err.Error()
+}
+
+// forwardFailed records a forward that stops working after the tunnel
+// started, such as a listener closed under it. Under best effort the
+// others keep running; otherwise the whole tunnel goes down.
+func (rt *RunningTunnel) forwardFailed(i int, err error) {
+	rt.setForwardErr(i, err)
+	msg := fmt.Sprintf("forward %d: %v", i+1, err)
+	status := rt.Status()
+	if up, _ := rt.forwardsUp(); rt.Cfg.bestEffort() && up > 0 {
+		// Same status with a new message tells subscribers to refresh
+		if status.isUp() {
+			rt.transitionFrom(status, status, msg)
+		}
+		return
+	}
+	if status.isUp() && rt.transitionFrom(status, StatusError, msg) {
+		rt.cleanupResources()
+		rt.state.releaseSSHConnection(rt)
+	}
+}
+
+// forwardErr returns why forward i is down, or "" if it is up.
+func (rt *RunningTunnel) forwardErr(i int) string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if i < len(rt.forwardErrs) {
+		return rt.forwardErrs[i]
+	}
+	return ""
+}
+
+// forwardsUp counts the forwards that have not failed.
+func (rt *RunningTunnel) forwardsUp() (up, total int) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	total = len(rt.Cfg.Forwards)
+	up = total
+	for _, e := range rt.forwardErrs {
+		if e != "" {
+			up--
+		}
+	}
+	return up, total
+}
+
+// firstForwardErr describes the first failed forward, for the tunnel list.
+func (rt *RunningTunnel) firstForwardErr() string {
+	for i := range rt.Cfg.Forwards {
+		if e := rt.forwardErr(i); e != "" {
+			return fmt.Sprintf("forward %d: %s", i+1, e)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"fyne.io/fyne/v2"
+)
+
+// headlessMu stands in for the UI goroutine when there is no window, so
+// state the UI goroutine otherwise owns is still touched by one at a time.
+var headlessMu sync.Mutex
+
+// onUI runs fn on the UI goroutine and waits for it, or under headlessMu
+// when running without a window.
+func (state *AppState) onUI(fn func()) {
+	if state.headless {
+		headlessMu.Lock()
+		defer headlessMu.Unlock()
+		fn()
+		return
+	}
+	fyne.DoAndWait(fn)
+}
+
+// runHeadless starts the tunnels marked to start with the app without
+// opening a window and keeps them up until interrupted. 2FA codes and
+// login prompts are asked on the terminal.
+func (state *AppState) runHeadless(configFile string) {
+	state.headless = true
+	cfgs, err := loadConfigFile(configFile)
+	if err != nil {
+		slog.Error("Failed to load config", "err", err)
+	}
+	state.configs = cfgs
+	state.publishConfigs()
+
+	settings, err := loadSettings(state.settingsFile)
+	if err != nil {
+		slog.Error("Failed to load settings", "err", err)
+	}
+	state.settings = settings
+	if err := state.applySettings(); err != nil {
+		slog.Error("Failed to apply settings", "err", err)
+	}
+
+	state.subscribeLog()
+	state.subscribePortsEnv()
+	state.startStatusMonitoring()
+
+	started := 0
+	for _, cfg := range state.configs {
+		if cfg.AutoStart {
+			state.startHeadless(cfg.ID)
+			started++
+		}
+	}
+	if started == 0 {
+		slog.Warn("No tunnels are set to start with the app, nothing to run headless")
+		state.cleanup()
+		return
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	slog.Info("Shutting down")
+	state.cleanup()
+}
+
+// startHeadless starts the tunnel with the given ID once its dependencies
+// are up, asking for a 2FA code on the terminal if it needs one.
+func (state *AppState) startHeadless(id string) {
+	idx := state.configIndex(id)
+	if idx < 0 {
+		return
+	}
+	if _, exists := state.getRunning(id); exists {
+		return
+	}
+	cfg := state.configs[idx]
+	for _, dep := range cfg.DependsOn {
+		state.startHeadless(dep)
+	}
+	if pending := state.pendingDependencies(cfg); len(pending) > 0 {
+		slog.Error("Not starting tunnel, dependencies are not up", "tunnel", id, "name", cfg.Name, "pending", pending)
+		return
+	}
+
+	rt := newRunningTunnel(cfg, state.events)
+	state.setRunning(id, rt)
+	code := ""
+	// On-demand tunnels ask for the code when they first connect
+	if !cfg.OnDemand && cfg.Auth.Use2FA && !state.hasSSHConnection(cfg) {
+		var ok bool
+		if code, ok = state.promptTwoFA(cfg); !ok {
+			slog.Warn("No 2FA code entered, not starting tunnel", "tunnel", id, "name", cfg.Name)
+			state.removeRunning(id, rt)
+			return
+		}
+	}
+	// start() logs and records its own failure
+	_ = rt.start(code, state)
+}
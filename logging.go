@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFileName    = "sshtunnel.log"
+	logFileMaxSize = 5 << 20
+	logFileBackups = 3
+	logBufferSize  = 5000
+)
+
+// LogEntry is one record kept in memory for the log viewer.
+type LogEntry struct {
+	Time     time.Time
+	Level    slog.Level
+	Message  string
+	TunnelID string
+	Attrs    string
+}
+
+func (e LogEntry) String() string {
+	line := fmt.Sprintf("%s %-5s %s", e.Time.Format("2006-01-02 15:04:05"), e.Level, e.Message)
+	if e.Attrs != "" {
+		line += " " + e.Attrs
+	}
+	return line
+}
+
+// logBuffer is a fixed-size ring of recent log entries.
+type logBuffer struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	next    int
+	full    bool
+	version uint64
+}
+
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{entries: make([]LogEntry, size)}
+}
+
+func (b *logBuffer) add(e LogEntry) {
+	b.mu.Lock()
+	b.entries[b.next] = e
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+	b.version++
+	b.mu.Unlock()
+}
+
+// snapshot returns the buffered entries oldest first, plus a version
+// number that changes whenever an entry is added.
+func (b *logBuffer) snapshot() ([]LogEntry, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]LogEntry(nil), b.entries[:b.next]...), b.version
+	}
+	out := make([]LogEntry, 0, len(b.entries))
+	out = append(out, b.entries[b.next:]...)
+	out = append(out, b.entries[:b.next]...)
+	return out, b.version
+}
+
+// logOutput is shared by every handler derived from the root one.
+type logOutput struct {
+	mu    sync.Mutex
+	level slog.LevelVar
+	w     []io.Writer
+	buf   *logBuffer
+}
+
+// appLogHandler writes logfmt-style lines to stderr and the log file and
+// keeps a copy of each record for the in-app log viewer.
+type appLogHandler struct {
+	out    *logOutput
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *appLogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.out.level.Level()
+}
+
+func (h *appLogHandler) Handle(_ context.Context, r slog.Record) error {
+	entry := LogEntry{Time: r.Time, Level: r.Level, Message: r.Message}
+	var sb strings.Builder
+	appendAttr := func(key string, v slog.Value) {
+		if key == "tunnel" {
+			entry.TunnelID = v.String()
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		s := v.String()
+		if s == "" || strings.ContainsAny(s, " \t\"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		sb.WriteString(key + "=" + s)
+	}
+	for _, a := range h.attrs {
+		appendAttr(a.Key, a.Value.Resolve())
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(h.prefix+a.Key, a.Value.Resolve())
+		return true
+	})
+	entry.Attrs = sb.String()
+	h.out.buf.add(entry)
+
+	line := entry.String() + "\n"
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	for _, w := range h.out.w {
+		io.WriteString(w, line)
+	}
+	return nil
+}
+
+func (h *appLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		nh.attrs = append(nh.attrs, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &nh
+}
+
+func (h *appLogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	nh := *h
+	nh.prefix = h.prefix + name + "."
+	return &nh
+}
+
+var appLog = &logOutput{
+	w:   []io.Writer{os.Stderr},
+	buf: newLogBuffer(logBufferSize),
+}
+
+// setupLogging installs the structured logger as the slog and log default.
+// Until openLogFile is called records only go to stderr and the viewer.
+func setupLogging() {
+	slog.SetDefault(slog.New(&appLogHandler{out: appLog}))
+}
+
+// openLogFile adds a rotating log file in dir to the log outputs.
+func openLogFile(dir string) (*rotatingWriter, error) {
+	path := filepath.Join(dir, logFileName)
+	w, err := newRotatingWriter(path, logFileMaxSize, logFileBackups)
+	if err != nil {
+		return nil, err
+	}
+	appLog.mu.Lock()
+	appLog.w = append(appLog.w, w)
+	appLog.mu.Unlock()
+	slog.Info("Logging to file", "path", path)
+	return w, nil
+}
+
+func parseLogLevel(s string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+func setLogLevel(s string) {
+	appLog.level.Set(parseLogLevel(s))
+}
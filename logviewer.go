@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+const allTunnels = "All tunnels"
+
+var logLevelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// showLogViewer opens a window listing recent log entries, filterable by
+// tunnel, minimum level and free text, with copy and export of the
+// filtered lines.
+func (state *AppState) showLogViewer(a fyne.App) {
+	if state.logWindow != nil {
+		state.logWindow.RequestFocus()
+		return
+	}
+	w := a.NewWindow("Logs")
+	w.Resize(fyne.NewSize(900, 500))
+	state.logWindow = w
+
+	var filtered []LogEntry
+	var lastVersion uint64
+
+	// Tunnel filter shows names but filters on IDs
+	tunnelIDs := map[string]string{allTunnels: ""}
+	options := []string{allTunnels}
+	for _, cfg := range state.configs {
+		label := tunnelLabel(cfg)
+		tunnelIDs[label] = cfg.ID
+		options = append(options, label)
+	}
+	tunnelSelect := widget.NewSelect(options, nil)
+	tunnelSelect.SetSelected(allTunnels)
+	levelSelect := widget.NewSelect(logLevelNames, nil)
+	levelSelect.SetSelected("INFO")
+	search := widget.NewEntry()
+	search.SetPlaceHolder("Filter text")
+
+	list := widget.NewList(
+		func() int { return len(filtered) },
+		func() fyne.CanvasObject { return widget.NewLabel("") },
+		func(i widget.ListItemID, o fyne.CanvasObject) {
+			if i < len(filtered) {
+				o.(*widget.Label).SetText(filtered[i].String())
+			}
+		},
+	)
+
+	apply := func(force bool) {
+		entries, version := appLog.buf.snapshot()
+		if !force && version == lastVersion {
+			return
+		}
+		lastVersion = version
+		tunnelID := tunnelIDs[tunnelSelect.Selected]
+		minLevel := parseLogLevel(levelSelect.Selected)
+		text := strings.ToLower(search.Text)
+		filtered = filtered[:0]
+		for _, e := range entries {
+			if e.Level < minLevel {
+				continue
+			}
+			if tunnelID != "" && e.TunnelID != tunnelID {
+				continue
+			}
+			if text != "" && !strings.Contains(strings.ToLower(e.String()), text) {
+				continue
+			}
+			filtered = append(filtered, e)
+		}
+		list.Refresh()
+		list.ScrollToBottom()
+	}
+	tunnelSelect.OnChanged = func(string) { apply(true) }
+	levelSelect.OnChanged = func(string) { apply(true) }
+	search.OnChanged = func(string) { apply(true) }
+
+	filteredText := func() string {
+		var sb strings.Builder
+		for _, e := range filtered {
+			sb.WriteString(e.String())
+			sb.WriteByte('\n')
+		}
+		return sb.String()
+	}
+	copyBtn := widget.NewButton("Copy", func() {
+		a.Clipboard().SetContent(filteredText())
+	})
+	exportBtn := widget.NewButton("Export...", func() {
+		d := dialog.NewFileSave(func(uc fyne.URIWriteCloser, err error) {
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			if uc == nil {
+				return
+			}
+			defer uc.Close()
+			if _, err := uc.Write([]byte(filteredText())); err != nil {
+				dialog.ShowError(err, w)
+			}
+		}, w)
+		d.SetFileName("sshtunnel-" + time.Now().Format("20060102-150405") + ".log")
+		d.Show()
+	})
+
+	filters := container.NewHBox(widget.NewLabel("Tunnel:"), tunnelSelect, widget.NewLabel("Level:"), levelSelect)
+	top := container.NewBorder(nil, nil, filters, container.NewHBox(copyBtn, exportBtn), search)
+	w.SetContent(container.NewBorder(top, nil, nil, nil, list))
+
+	// Poll for new entries while the window is open
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fyne.Do(func() { apply(false) })
+			case <-done:
+				return
+			}
+		}
+	}()
+	w.SetOnClosed(func() {
+		close(done)
+		state.logWindow = nil
+	})
+	apply(true)
+	w.Show()
+}
+
+// shortID abbreviates a tunnel ID for display.
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
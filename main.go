@@ -1,11 +1,12 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"strconv"
 	"time"
 
 	"fyne.io/fyne/v2"
@@ -46,7 +47,7 @@ func getConfigPath() string {
 	// Check which location has an existing config file
 	for _, path := range locations {
 		if _, err := os.Stat(path); err == nil {
-			log.Printf("Found existing config at: %s", path)
+			slog.Info("Found existing config", "path", path)
 			return path
 		}
 	}
@@ -56,31 +57,65 @@ func getConfigPath() string {
 		appConfigDir := filepath.Join(configDir, "SSH-Tunnels")
 		os.MkdirAll(appConfigDir, 0755)
 		configPath := filepath.Join(appConfigDir, "tunnels.json")
-		log.Printf("Using new config location: %s", configPath)
+		slog.Info("Using new config location", "path", configPath)
 		return configPath
 	}
 	
 	// Fallback to home directory
 	if homeDir, err := os.UserHomeDir(); err == nil {
 		configPath := filepath.Join(homeDir, "tunnels.json")
-		log.Printf("Fallback config location: %s", configPath)
+		slog.Info("Fallback config location", "path", configPath)
 		return configPath
 	}
 	
 	// Last resort - current directory
-	log.Printf("Using current directory for config: tunnels.json")
+	slog.Info("Using current directory for config", "path", "tunnels.json")
 	return "tunnels.json"
 }
 
+func newAppState(configFile string) *AppState {
+	state := &AppState{
+		running:      make(map[string]*RunningTunnel),
+		events:       newEventBus(),
+		selectedIdx:  -1,
+		connections:  make(map[string]*sshConnection),
+		settingsFile: settingsPath(configFile),
+	}
+
+	// Keep a rotating log next to the config file
+	if lf, err := openLogFile(filepath.Dir(configFile)); err != nil {
+		slog.Warn("File logging disabled", "err", err)
+	} else {
+		state.logFile = lf
+	}
+	if af, err := openAuditLog(filepath.Dir(configFile)); err != nil {
+		slog.Warn("Connection audit log disabled", "err", err)
+	} else {
+		state.auditFile = af
+	}
+	return state
+}
+
 func main() {
+	setupLogging()
+	headless := flag.Bool("headless", false, "start the auto-start tunnels without a window and ask for logins on the terminal")
+	flag.Parse()
+
+	// Use intelligent config path detection
+	configFile := getConfigPath()
+	slog.Info("Using config file", "path", configFile)
+
+	state := newAppState(configFile)
+	if *headless {
+		state.runHeadless(configFile)
+		return
+	}
+
 	a := app.New()
 	
 	w := a.NewWindow("SSH Tunnels + Web Proxy @GraysonLee - v2.0")
 	w.Resize(fyne.NewSize(980, 620))
 
-	// Use intelligent config path detection
-	configFile := getConfigPath()
-	log.Printf("Using config file: %s", configFile)
 	// Add menu to show config location
 	mainMenu := fyne.NewMainMenu(
 		fyne.NewMenu("File",
@@ -94,6 +129,12 @@ func main() {
 				dialog.ShowInformation("Config Folder", 
 					fmt.Sprintf("Config folder location:\n\n%s\n\nYou can open this folder in Finder to manually edit or backup your config files.", configDir), w)
 			}),
+			fyne.NewMenuItemSeparator(),
+			fyne.NewMenuItem("Settings...", func() { state.settingsDialog(w) }),
+			fyne.NewMenuItem("Router...", func() { state.routerDialog(w) }),
+		),
+		fyne.NewMenu("View",
+			fyne.NewMenuItem("Logs", func() { state.showLogViewer(a) }),
 		),
 		fyne.NewMenu("Help",
 			fyne.NewMenuItem("About", func() {
@@ -102,19 +143,21 @@ func main() {
 		),
 	)
 	w.SetMainMenu(mainMenu)
-	
-	state := &AppState{
-		running:     make(map[int]*RunningTunnel),
-		selectedIdx: -1,
-		connections: make(map[string]*sshConnection),
-	}
 
 	// Load configs
-	cfgs, err := loadConfigFile(configFile)
-	if err != nil {
-		log.Printf("Failed to load config: %v", err)
+	cfgs, configErr := loadConfigFile(configFile)
+	if configErr != nil {
+		slog.Error("Failed to load config", "err", configErr)
 	}
 	state.configs = cfgs
+	state.publishConfigs()
+
+	settings, err := loadSettings(state.settingsFile)
+	if err != nil {
+		slog.Error("Failed to load settings", "err", err)
+	}
+	state.settings = settings
+	settingsErr := state.applySettings()
 
 	// List with enhanced status display
 	state.list = widget.NewList(
@@ -133,8 +176,17 @@ func main() {
 		},
 	)
 
-	state.list.OnSelected = func(id widget.ListItemID) { state.selectedIdx = id }
-	state.list.OnUnselected = func(id widget.ListItemID) { state.selectedIdx = -1 }
+	// Traffic statistics for the selected tunnel
+	state.details = newDetailPane(state)
+
+	state.list.OnSelected = func(id widget.ListItemID) {
+		state.selectedIdx = id
+		state.details.refresh()
+	}
+	state.list.OnUnselected = func(id widget.ListItemID) {
+		state.selectedIdx = -1
+		state.details.refresh()
+	}
 
 	// Buttons
 	btnAdd := widget.NewButton("Add Tunnel", func() { state.addTunnelDialog(w, configFile) })
@@ -142,22 +194,47 @@ func main() {
 	btnDelete := widget.NewButton("Delete", func() { state.deleteSelected(configFile) })
 	btnStart := widget.NewButton("Start", func() { state.startSelected(w) })
 	btnStop := widget.NewButton("Stop", func() { state.stopSelected() })
+	btnUp := widget.NewButtonWithIcon("", theme.MoveUpIcon(), func() { state.moveSelected(-1, configFile) })
+	btnDown := widget.NewButtonWithIcon("", theme.MoveDownIcon(), func() { state.moveSelected(1, configFile) })
 
 	state.status = widget.NewLabel("Ready")
 	state.updateStatus()
+	if settingsErr != nil {
+		state.status.SetText(settingsErr.Error())
+	}
+	if configErr != nil {
+		state.status.SetText(configErr.Error())
+	}
+
+	// The list, status bar, log and notifications all follow the tunnel event stream
+	state.subscribeUI()
+	state.subscribeLog()
+	state.subscribeNotifications(a)
+	state.subscribePortsEnv()
 
 	// Start connection monitoring
 	state.startStatusMonitoring()
+	state.startFailbackMonitor()
 
-	buttons := container.NewHBox(btnAdd, btnEdit, btnDelete, btnStart, btnStop)
-	content := container.NewBorder(nil, container.NewVBox(buttons, state.status), nil, nil, state.list)
+	// Pick up edits made to the config file outside the app
+	if err := state.watchConfigFile(configFile, w); err != nil {
+		slog.Warn("Config hot-reload disabled", "err", err)
+	}
+
+	buttons := container.NewHBox(btnAdd, btnEdit, btnDelete, btnStart, btnStop, btnUp, btnDown)
+	split := container.NewHSplit(state.list, state.details.content)
+	split.Offset = 0.45
+	content := container.NewBorder(nil, container.NewVBox(buttons, state.status), nil, nil, split)
+	state.details.start()
 
 	w.SetContent(content)
 	
-	// Cleanup when window closes
-	w.SetOnClosed(func() {
-		state.cleanup()
-	})
+	// With a tray icon closing the window only hides it, so clean up
+	// when the app itself quits
+	state.window = w
+	state.setupTray(a, w)
+	a.Lifecycle().SetOnStopped(state.cleanup)
+	a.Lifecycle().SetOnStarted(func() { state.autoStartTunnels(w) })
 	
 	w.ShowAndRun()
 }
@@ -173,12 +250,15 @@ func updateListItem(i widget.ListItemID, o fyne.CanvasObject, state *AppState) {
 	dot := dotContainer.Objects[0].(*canvas.Circle)
 	lbl := row.Objects[1].(*widget.Label)
 
-	if rt, running := state.running[i]; running {
-		switch rt.Status {
+	if rt, running := state.getRunning(cfg.ID); running {
+		status := rt.Status()
+		switch status {
 		case StatusConnecting:
 			dot.FillColor = theme.WarningColor() // Yellow/Orange for connecting
 		case StatusConnected:
 			dot.FillColor = theme.SuccessColor() // Green for connected
+		case StatusIdle:
+			dot.FillColor = theme.PrimaryColor() // Listening, connects on demand
 		case StatusError, StatusDisconnected:
 			dot.FillColor = theme.ErrorColor() // Red for error/disconnected
 		default:
@@ -186,9 +266,21 @@ func updateListItem(i widget.ListItemID, o fyne.CanvasObject, state *AppState) {
 		}
 		
 		statusText := fmt.Sprintf("%s (%s:%d) - %s", 
-			cfg.Name, cfg.SSHHost, cfg.SSHPort, rt.Status.String())
-		if rt.Status == StatusError && rt.ErrorMsg != "" {
-			statusText += fmt.Sprintf(" [%s]", rt.ErrorMsg)
+			cfg.Name, cfg.SSHHost, cfg.SSHPort, status.String())
+		up, total := rt.forwardsUp()
+		if status.isUp() && up < total {
+			statusText += fmt.Sprintf(" (%d/%d forwards)", up, total)
+		}
+		if ep, ok := state.sshEndpoint(cfg); ok && state.failedOver(cfg) {
+			statusText += " via " + ep.addr()
+		}
+		if ports := rt.allocatedPorts(); ports != "" {
+			statusText += " on " + ports
+		}
+		if errMsg := rt.ErrorMsg(); (status == StatusError || status == StatusIdle) && errMsg != "" {
+			statusText += fmt.Sprintf(" [%s]", errMsg)
+		} else if status.isUp() && up < total {
+			statusText += fmt.Sprintf(" [%s]", rt.firstForwardErr())
 		}
 		lbl.SetText(statusText)
 	} else {
@@ -203,19 +295,23 @@ func (state *AppState) refreshList() {
 	if state.list != nil {
 		state.list.Refresh()
 	}
+	state.refreshTray()
 }
 
 func (state *AppState) updateStatus() {
 	status := "Ready"
-	if len(state.running) > 0 {
+	if running := state.runningTunnels(); len(running) > 0 {
 		connected := 0
+		idle := 0
 		connecting := 0
 		errors := 0
 		
-		for _, rt := range state.running {
-			switch rt.Status {
+		for _, rt := range running {
+			switch rt.Status() {
 			case StatusConnected:
 				connected++
+			case StatusIdle:
+				idle++
 			case StatusConnecting:
 				connecting++
 			case StatusError, StatusDisconnected:
@@ -227,6 +323,9 @@ func (state *AppState) updateStatus() {
 		if connected > 0 {
 			statusParts = append(statusParts, fmt.Sprintf("%d connected", connected))
 		}
+		if idle > 0 {
+			statusParts = append(statusParts, fmt.Sprintf("%d idle", idle))
+		}
 		if connecting > 0 {
 			statusParts = append(statusParts, fmt.Sprintf("%d connecting", connecting))
 		}
@@ -248,105 +347,128 @@ func (state *AppState) startSelected(w fyne.Window) {
 	if state.selectedIdx < 0 || state.selectedIdx >= len(state.configs) {
 		return
 	}
-	idx := state.selectedIdx
-	
-	// Check if there's already a tunnel running/connecting for this index
-	if rt, exists := state.running[idx]; exists {
-		if rt.Status == StatusConnected {
+	state.startTunnel(state.configs[state.selectedIdx].ID, w)
+}
+
+// configIndex returns the list position of the tunnel with the given ID,
+// or -1 if it no longer exists.
+func (state *AppState) configIndex(id string) int {
+	for i, cfg := range state.configs {
+		if cfg.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (state *AppState) startTunnel(id string, w fyne.Window) {
+	idx := state.configIndex(id)
+	if idx < 0 {
+		return
+	}
+	// Check if there's already a tunnel running/connecting for this ID
+	if rt, exists := state.getRunning(id); exists {
+		switch rt.Status() {
+		case StatusConnected, StatusIdle:
 			state.status.SetText("Tunnel already running")
 			return
-		} else if rt.Status == StatusConnecting {
+		case StatusConnecting:
 			state.status.SetText("Tunnel is already connecting")
 			return
-		} else if rt.Status == StatusDisconnected || rt.Status == StatusError {
+		case StatusDisconnected, StatusError:
 			// Clean up the old disconnected tunnel first
-			log.Printf("Cleaning up old disconnected tunnel before starting new one")
+			slog.Info("Cleaning up old tunnel before starting new one", "tunnel", id)
 			rt.stop(state)
-			delete(state.running, idx)
+			state.removeRunning(id, rt)
+			metrics.incReconnects(rt.Cfg)
 		}
 	}
 	
 	cfg := state.configs[idx]
-	rt := &RunningTunnel{
-		Cfg:    cfg,
-		Status: StatusConnecting,
-	}
-	state.running[idx] = rt
-	
-	// Immediately refresh to show "connecting" status
-	state.refreshList()
-	state.updateStatus()
+	rt := newRunningTunnel(cfg, state.events)
+	state.setRunning(id, rt)
+	// Show "connecting" straight away; the event subscriber refreshes the list
+	rt.transition(StatusConnecting, "")
 	
-	var twoFACode string
-	key := fmt.Sprintf("%s@%s:%d", cfg.Auth.User, cfg.SSHHost, cfg.SSHPort)
-	
-	if _, exists := state.connections[key]; !exists && cfg.Auth.Use2FA {
-		codeEntry := widget.NewEntry()
-		codeEntry.SetPlaceHolder("Enter 2FA code")
-		d := dialog.NewForm("2FA Required", "Connect", "Cancel", []*widget.FormItem{
-			{Text: "Code:", Widget: codeEntry},
-		}, func(confirm bool) {
+	// Bring dependencies up first and connect once they are all connected
+	if pending := state.pendingDependencies(cfg); len(pending) > 0 {
+		for _, dep := range pending {
+			state.startTunnel(dep, w)
+		}
+		state.status.SetText("Waiting for dependencies...")
+		safeGo(func() { state.waitForDependencies(rt, pending, w) })
+		return
+	}
+	state.connectTunnel(rt, w)
+}
+
+// connectTunnel asks for a 2FA code if needed and connects rt, which must
+// already be registered and Connecting.
+func (state *AppState) connectTunnel(rt *RunningTunnel, w fyne.Window) {
+	id, cfg := rt.Cfg.ID, rt.Cfg
+	if cur, ok := state.getRunning(id); !ok || cur != rt || rt.Status() != StatusConnecting {
+		// Stopped while waiting
+		return
+	}
+	// On-demand tunnels ask for the code when they first connect
+	if !cfg.OnDemand && !state.hasSSHConnection(cfg) && cfg.Auth.Use2FA {
+		state.requestTwoFA(cfg, w, func(twoFACode string, confirm bool) {
 			if !confirm {
 				// User cancelled - remove from running
-				delete(state.running, idx)
+				rt.transition(StatusStopped, "")
+				state.removeRunning(id, rt)
 				state.updateStatus()
 				state.refreshList()
 				return
 			}
-			twoFACode = codeEntry.Text
-			if twoFACode == "" {
-				rt.Status = StatusError
-				rt.ErrorMsg = "2FA code cannot be empty"
-				state.refreshList()
-				state.updateStatus()
+			if twoFACode == "" && !state.hasSSHConnection(cfg) {
+				rt.transition(StatusError, "2FA code cannot be empty")
 				return
 			}
 			
 			state.status.SetText("Connecting...")
-			go state.attemptConnection(idx, twoFACode)
-		}, w)
-		d.Show()
+			go state.attemptConnection(rt, twoFACode)
+		})
 	} else {
 		state.status.SetText("Connecting...")
-		go state.attemptConnection(idx, "")
+		go state.attemptConnection(rt, "")
 	}
 }
 
-func (state *AppState) attemptConnection(idx int, twoFACode string) {
-	rt := state.running[idx]
+func (state *AppState) attemptConnection(rt *RunningTunnel, twoFACode string) {
+	// start() drives the status transitions itself; only the message is set here
+	err := rt.start(twoFACode, state)
 	
-	// Your existing connection logic here
-	err := rt.start(twoFACode, state) // Your existing start method
-	
-	if err != nil {
-		rt.Status = StatusError
-		rt.ErrorMsg = err.Error()
-		state.status.SetText(fmt.Sprintf("Failed to connect: %v", err))
-	} else {
-		rt.Status = StatusConnected
-		rt.LastHeartbeat = time.Now()
-		state.status.SetText("Tunnel connected successfully")
-	}
-	
-	state.updateStatus()
-	state.refreshList()
+	fyne.Do(func() {
+		if err != nil {
+			state.status.SetText(fmt.Sprintf("Failed to connect: %v", err))
+			var inUse *portInUseError
+			if errors.As(err, &inUse) && inUse.canStop() {
+				state.offerStopPortOwner(rt, inUse)
+			}
+		} else {
+			state.status.SetText("Tunnel connected successfully")
+		}
+	})
 }
 
 func (state *AppState) stopSelected() {
 	if state.selectedIdx < 0 || state.selectedIdx >= len(state.configs) {
 		return
 	}
-	idx := state.selectedIdx
-	rt, exists := state.running[idx]
+	state.stopTunnel(state.configs[state.selectedIdx].ID)
+}
+
+func (state *AppState) stopTunnel(id string) {
+	rt, exists := state.getRunning(id)
 	if !exists {
 		state.status.SetText("Tunnel not running")
 		return
 	}
 	
 	state.status.SetText("Stopping tunnel...")
-	rt.Status = StatusStopped
 	rt.stop(state) // Your existing stop method
-	delete(state.running, idx)
+	state.removeRunning(id, rt)
 	state.updateStatus()
 	state.refreshList()
 }
@@ -362,59 +484,60 @@ func (state *AppState) startStatusMonitoring() {
 }
 
 func (state *AppState) checkConnectionHealth() {
-	needsRefresh := false
-	
-	for idx, rt := range state.running {
-		if rt.Status == StatusConnected {
+	for id, rt := range state.runningTunnels() {
+		if rt.Status() == StatusConnected {
 			// Check if connection is still healthy
-			if !state.isConnectionHealthy(rt) {
-				log.Printf("Connection lost for tunnel %d, cleaning up resources", idx)
-				rt.Status = StatusDisconnected
-				rt.ErrorMsg = "Connection lost"
+			healthy := state.isConnectionHealthy(rt)
+			if !healthy && rt.Cfg.OnDemand {
+				// Keep listening and reconnect on the next client
+				slog.Warn("Connection lost, going idle", "tunnel", id)
+				rt.goIdle("Connection lost")
+			} else if !healthy {
+				slog.Warn("Connection lost, cleaning up resources", "tunnel", id)
+				if !rt.transitionFrom(StatusConnected, StatusDisconnected, "Connection lost") {
+					// Stopped or failed concurrently
+					continue
+				}
 				
 				// Important: Clean up the tunnel resources when connection is lost
-				go func(tunnel *RunningTunnel, tunnelIdx int) {
+				go func(tunnel *RunningTunnel, tunnelID string) {
 					defer func() {
 						if r := recover(); r != nil {
-							log.Printf("Panic during auto-cleanup: %v", r)
+							slog.Error("Panic during auto-cleanup", "panic", r)
 						}
 					}()
 					
-					log.Printf("Auto-cleaning up disconnected tunnel %d", tunnelIdx)
+					slog.Info("Auto-cleaning up disconnected tunnel", "tunnel", tunnelID)
 					tunnel.stop(state)
 					
-					// Remove from running tunnels
-					state.connMu.Lock()
-					delete(state.running, tunnelIdx)
-					state.connMu.Unlock()
+					// Remove from running tunnels, unless it was restarted meanwhile
+					state.removeRunning(tunnelID, tunnel)
 					
 					// Update UI
-					state.updateStatus()
-					state.refreshList()
-				}(rt, idx)
-				
-				needsRefresh = true
+					if !state.headless {
+						fyne.Do(func() {
+							state.updateStatus()
+							state.refreshList()
+						})
+					}
+				}(rt, id)
 			} else {
-				rt.LastHeartbeat = time.Now()
+				rt.touch()
 			}
 		}
 	}
-	
-	if needsRefresh {
-		state.refreshList()
-		state.updateStatus()
-	}
 }
 
 func (state *AppState) isConnectionHealthy(rt *RunningTunnel) bool {
-	if rt.Client == nil {
+	client := rt.sshClient()
+	if client == nil {
 		return false
 	}
 	
 	// Try to create a simple session to test if connection is alive
-	session, err := rt.Client.NewSession()
+	session, err := client.NewSession()
 	if err != nil {
-		log.Printf("Health check failed for %s@%s:%d: %v", rt.Cfg.Auth.User, rt.Cfg.SSHHost, rt.Cfg.SSHPort, err)
+		rt.log.Warn("Health check failed", "ssh", connectionKey(rt.Cfg), "err", err)
 		return false
 	}
 	session.Close()
@@ -425,20 +548,30 @@ func (state *AppState) isConnectionHealthy(rt *RunningTunnel) bool {
 func (state *AppState) cleanup() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Panic in cleanup recovered: %v", r)
+			slog.Error("Panic in cleanup recovered", "panic", r)
 		}
 	}()
 
 	if state.statusTicker != nil {
 		state.statusTicker.Stop()
 	}
+	if state.failbackTicker != nil {
+		state.failbackTicker.Stop()
+	}
+	if state.watcher != nil {
+		state.watcher.Close()
+	}
+	if state.details != nil {
+		state.details.stop()
+	}
+	_ = state.restartMetricsServer("")
 	
 	// Stop all running tunnels with error handling
-	for idx, rt := range state.running {
+	for id, rt := range state.runningTunnels() {
 		func() {
 			defer func() {
 				if r := recover(); r != nil {
-					log.Printf("Panic stopping tunnel %d: %v", idx, r)
+					slog.Error("Panic stopping tunnel", "tunnel", id, "panic", r)
 				}
 			}()
 			rt.stop(state)
@@ -449,7 +582,7 @@ func (state *AppState) cleanup() {
 	func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("Panic closing connections: %v", r)
+				slog.Error("Panic closing connections", "panic", r)
 			}
 		}()
 		
@@ -460,7 +593,7 @@ func (state *AppState) cleanup() {
 			func() {
 				defer func() {
 					if r := recover(); r != nil {
-						log.Printf("Panic closing connection %s: %v", key, r)
+						slog.Error("Panic closing connection", "ssh", key, "panic", r)
 					}
 				}()
 				
@@ -473,64 +606,40 @@ func (state *AppState) cleanup() {
 		// Clear the connections map
 		state.connections = make(map[string]*sshConnection)
 	}()
+
+	if state.router != nil {
+		state.router.ln.Close()
+	}
+	if state.auditFile != nil {
+		state.auditFile.Close()
+	}
+	if state.logFile != nil {
+		state.logFile.Close()
+	}
 }
 
 // Keep all your existing dialog functions (addTunnelDialog, editSelected, deleteSelected)
 // These remain the same as in your original code
 
+// parseForwardType maps a forward type choice in the dialogs to its type.
+func parseForwardType(label string) ForwardType {
+	switch label {
+	case "Remote":
+		return ForwardRemote
+	case "Dynamic (SOCKS)":
+		return ForwardDynamic
+	case "DNS":
+		return ForwardDNS
+	default:
+		return ForwardLocal
+	}
+}
+
 func (state *AppState) addTunnelDialog(w fyne.Window, configFile string) {
-	nameEntry := widget.NewEntry()
-	nameEntry.SetPlaceHolder("My SSH Tunnel")
-	sshHostEntry := widget.NewEntry()
-	sshHostEntry.SetPlaceHolder("abc.com")
-	sshPortEntry := widget.NewEntry()
-	sshPortEntry.SetText("22")
-	userEntry := widget.NewEntry()
-	userEntry.SetPlaceHolder("SSH Username")
-	passwordEntry := widget.NewPasswordEntry()
-	passwordEntry.SetPlaceHolder("SSH Password (optional)")
-	keyPathEntry := widget.NewEntry()
-	keyPathEntry.SetPlaceHolder("/path/to/ssh/key (optional)")
-	keyPassEntry := widget.NewPasswordEntry()
-	keyPassEntry.SetPlaceHolder("Key Passphrase (optional)")
-	use2FACheck := widget.NewCheck("Enable 2FA", nil)
-	localAddrEntry := widget.NewEntry()
-	localAddrEntry.SetPlaceHolder("127.0.0.1:1234")
-	remoteAddrEntry := widget.NewEntry()
-	remoteAddrEntry.SetPlaceHolder("123.123.123.123:22")
-	forwardTypeSelect := widget.NewSelect([]string{"Local", "Remote", "Dynamic (SOCKS)"}, nil)
-	forwardTypeSelect.SetSelected("Local")
-	useProxyCheck := widget.NewCheck("Use HTTP Proxy", nil)
-	proxyHostEntry := widget.NewEntry()
-	proxyHostEntry.SetPlaceHolder("proxy.company.com")
-	proxyPortEntry := widget.NewEntry()
-	proxyPortEntry.SetText("80")
-	proxyUserEntry := widget.NewEntry()
-	proxyUserEntry.SetPlaceHolder("proxy_username")
-	proxyPassEntry := widget.NewPasswordEntry()
-	proxyPassEntry.SetPlaceHolder("proxy_password")
-	proxyTLSCheck := widget.NewCheck("HTTPS Proxy", nil)
+	tf := state.newTunnelForm(TunnelConfig{}, w)
 
 	// Create form with scrollable content
-	form := widget.NewForm(
-		&widget.FormItem{Text: "Name:", Widget: nameEntry},
-		&widget.FormItem{Text: "SSH Host:", Widget: sshHostEntry},
-		&widget.FormItem{Text: "SSH Port:", Widget: sshPortEntry},
-		&widget.FormItem{Text: "Username:", Widget: userEntry},
-		&widget.FormItem{Text: "Password:", Widget: passwordEntry},
-		&widget.FormItem{Text: "Key Path:", Widget: keyPathEntry},
-		&widget.FormItem{Text: "Key Passphrase:", Widget: keyPassEntry},
-		&widget.FormItem{Text: "", Widget: use2FACheck},
-		&widget.FormItem{Text: "Forward Type:", Widget: forwardTypeSelect},
-		&widget.FormItem{Text: "Local Address:", Widget: localAddrEntry},
-		&widget.FormItem{Text: "Remote Address:", Widget: remoteAddrEntry},
-		&widget.FormItem{Text: "", Widget: useProxyCheck},
-		&widget.FormItem{Text: "Proxy Host:", Widget: proxyHostEntry},
-		&widget.FormItem{Text: "Proxy Port:", Widget: proxyPortEntry},
-		&widget.FormItem{Text: "Proxy User:", Widget: proxyUserEntry},
-		&widget.FormItem{Text: "Proxy Pass:", Widget: proxyPassEntry},
-		&widget.FormItem{Text: "", Widget: proxyTLSCheck},
-	)
+	form := widget.NewForm(tf.items()...)
 	form.SubmitText = ""
 	form.CancelText = ""
 
@@ -543,57 +652,25 @@ func (state *AppState) addTunnelDialog(w fyne.Window, configFile string) {
 		if !confirm {
 			return
 		}
-		port, _ := strconv.Atoi(sshPortEntry.Text)
-		if port == 0 {
-			port = 22
-		}
-		var forwardType ForwardType
-		switch forwardTypeSelect.Selected {
-		case "Remote":
-			forwardType = ForwardRemote
-		case "Dynamic (SOCKS)":
-			forwardType = ForwardDynamic
-		default:
-			forwardType = ForwardLocal
-		}
-		var proxy *ProxyConfig
-		if useProxyCheck.Checked {
-			proxyPort, _ := strconv.Atoi(proxyPortEntry.Text)
-			if proxyPort == 0 {
-				proxyPort = 8080
-			}
-			proxy = &ProxyConfig{
-				Host:     proxyHostEntry.Text,
-				Port:     proxyPort,
-				Username: proxyUserEntry.Text,
-				Password: proxyPassEntry.Text,
-				TLS:      proxyTLSCheck.Checked,
-			}
+		cfg, err := tf.apply(TunnelConfig{ID: newTunnelID()})
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
 		}
-		cfg := TunnelConfig{
-			Name:    nameEntry.Text,
-			SSHHost: sshHostEntry.Text,
-			SSHPort: port,
-			Auth: SSHAuthConfig{
-				User:          userEntry.Text,
-				Password:      passwordEntry.Text,
-				KeyPath:       keyPathEntry.Text,
-				KeyPassphrase: keyPassEntry.Text,
-				Use2FA:        use2FACheck.Checked,
-			},
-			Proxy: proxy,
-			Forwards: []ForwardConfig{{
-				Type:       forwardType,
-				LocalAddr:  localAddrEntry.Text,
-				RemoteAddr: remoteAddrEntry.Text,
-			}},
+		// Save only what the hot-reload path would accept back
+		candidate := append(append([]TunnelConfig(nil), state.configs...), cfg)
+		if err := validateConfigs(candidate); err != nil {
+			dialog.ShowError(err, w)
+			return
 		}
-		state.configs = append(state.configs, cfg)
+		state.configs = candidate
+		state.publishConfigs()
 		if err := saveConfigFile(state.configs, configFile); err != nil {
 			dialog.ShowError(err, w)
 			return
 		}
 		state.refreshList()
+		warnExposure(cfg, w)
 	}, w)
 	d.Resize(fyne.NewSize(450, 550))
 	d.Show()
@@ -604,71 +681,11 @@ func (state *AppState) editSelected(w fyne.Window, configFile string) {
 		dialog.ShowInformation("No Selection", "Please select a tunnel to edit.", w)
 		return
 	}
-	idx := state.selectedIdx
-	cfg := state.configs[idx]
-	nameEntry := widget.NewEntry()
-	nameEntry.SetText(cfg.Name)
-	sshHostEntry := widget.NewEntry()
-	sshHostEntry.SetText(cfg.SSHHost)
-	sshPortEntry := widget.NewEntry()
-	sshPortEntry.SetText(strconv.Itoa(cfg.SSHPort))
-	userEntry := widget.NewEntry()
-	userEntry.SetText(cfg.Auth.User)
-	passwordEntry := widget.NewPasswordEntry()
-	passwordEntry.SetText(cfg.Auth.Password)
-	keyPathEntry := widget.NewEntry()
-	keyPathEntry.SetText(cfg.Auth.KeyPath)
-	keyPassEntry := widget.NewPasswordEntry()
-	keyPassEntry.SetText(cfg.Auth.KeyPassphrase)
-	use2FACheck := widget.NewCheck("Enable 2FA", nil)
-	use2FACheck.SetChecked(cfg.Auth.Use2FA)
-	localAddrEntry := widget.NewEntry()
-	remoteAddrEntry := widget.NewEntry()
-	forwardTypeSelect := widget.NewSelect([]string{"Local", "Remote", "Dynamic (SOCKS)"}, nil)
-	if len(cfg.Forwards) > 0 {
-		localAddrEntry.SetText(cfg.Forwards[0].LocalAddr)
-		remoteAddrEntry.SetText(cfg.Forwards[0].RemoteAddr)
-		forwardTypeSelect.SetSelected(cfg.Forwards[0].Type.String())
-	}
-	useProxyCheck := widget.NewCheck("Use HTTP Proxy", nil)
-	proxyHostEntry := widget.NewEntry()
-	proxyHostEntry.SetPlaceHolder("proxy.company.com")
-	proxyPortEntry := widget.NewEntry()
-	proxyPortEntry.SetText("80")
-	proxyUserEntry := widget.NewEntry()
-	proxyUserEntry.SetPlaceHolder("proxy_username")
-	proxyPassEntry := widget.NewPasswordEntry()
-	proxyPassEntry.SetPlaceHolder("proxy_password")
-	proxyTLSCheck := widget.NewCheck("HTTPS Proxy", nil)
-	if cfg.Proxy != nil {
-		useProxyCheck.SetChecked(true)
-		proxyHostEntry.SetText(cfg.Proxy.Host)
-		proxyPortEntry.SetText(strconv.Itoa(cfg.Proxy.Port))
-		proxyUserEntry.SetText(cfg.Proxy.Username)
-		proxyPassEntry.SetText(cfg.Proxy.Password)
-		proxyTLSCheck.SetChecked(cfg.Proxy.TLS)
-	}
+	cfg := state.configs[state.selectedIdx]
+	tf := state.newTunnelForm(cfg, w)
 
 	// Create form with scrollable content
-	form := widget.NewForm(
-		&widget.FormItem{Text: "Name:", Widget: nameEntry},
-		&widget.FormItem{Text: "SSH Host:", Widget: sshHostEntry},
-		&widget.FormItem{Text: "SSH Port:", Widget: sshPortEntry},
-		&widget.FormItem{Text: "Username:", Widget: userEntry},
-		&widget.FormItem{Text: "Password:", Widget: passwordEntry},
-		&widget.FormItem{Text: "Key Path:", Widget: keyPathEntry},
-		&widget.FormItem{Text: "Key Passphrase:", Widget: keyPassEntry},
-		&widget.FormItem{Text: "", Widget: use2FACheck},
-		&widget.FormItem{Text: "Forward Type:", Widget: forwardTypeSelect},
-		&widget.FormItem{Text: "Local Address:", Widget: localAddrEntry},
-		&widget.FormItem{Text: "Remote Address:", Widget: remoteAddrEntry},
-		&widget.FormItem{Text: "", Widget: useProxyCheck},
-		&widget.FormItem{Text: "Proxy Host:", Widget: proxyHostEntry},
-		&widget.FormItem{Text: "Proxy Port:", Widget: proxyPortEntry},
-		&widget.FormItem{Text: "Proxy User:", Widget: proxyUserEntry},
-		&widget.FormItem{Text: "Proxy Pass:", Widget: proxyPassEntry},
-		&widget.FormItem{Text: "", Widget: proxyTLSCheck},
-	)
+	form := widget.NewForm(tf.items()...)
 	form.SubmitText = ""
 	form.CancelText = ""
 
@@ -681,56 +698,33 @@ func (state *AppState) editSelected(w fyne.Window, configFile string) {
 		if !confirm {
 			return
 		}
-		port, _ := strconv.Atoi(sshPortEntry.Text)
-		if port == 0 {
-			port = 22
-		}
-		var forwardType ForwardType
-		switch forwardTypeSelect.Selected {
-		case "Remote":
-			forwardType = ForwardRemote
-		case "Dynamic (SOCKS)":
-			forwardType = ForwardDynamic
-		default:
-			forwardType = ForwardLocal
+		// The list may have been reloaded or reordered while the dialog was open
+		idx := state.configIndex(cfg.ID)
+		if idx < 0 {
+			dialog.ShowInformation("Tunnel Removed", "This tunnel no longer exists in the configuration.", w)
+			return
 		}
-		var proxy *ProxyConfig
-		if useProxyCheck.Checked {
-			proxyPort, _ := strconv.Atoi(proxyPortEntry.Text)
-			if proxyPort == 0 {
-				proxyPort = 8080
-			}
-			proxy = &ProxyConfig{
-				Host:     proxyHostEntry.Text,
-				Port:     proxyPort,
-				Username: proxyUserEntry.Text,
-				Password: proxyPassEntry.Text,
-				TLS:      proxyTLSCheck.Checked,
-			}
+		// Start from the stored config so settings the dialog doesn't show,
+		// and any further forwards, survive the edit
+		updated, err := tf.apply(state.configs[idx])
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
 		}
-		state.configs[idx] = TunnelConfig{
-			Name:    nameEntry.Text,
-			SSHHost: sshHostEntry.Text,
-			SSHPort: port,
-			Auth: SSHAuthConfig{
-				User:          userEntry.Text,
-				Password:      passwordEntry.Text,
-				KeyPath:       keyPathEntry.Text,
-				KeyPassphrase: keyPassEntry.Text,
-				Use2FA:        use2FACheck.Checked,
-			},
-			Proxy: proxy,
-			Forwards: []ForwardConfig{{
-				Type:       forwardType,
-				LocalAddr:  localAddrEntry.Text,
-				RemoteAddr: remoteAddrEntry.Text,
-			}},
+		candidate := append([]TunnelConfig(nil), state.configs...)
+		candidate[idx] = updated
+		if err := validateConfigs(candidate); err != nil {
+			dialog.ShowError(err, w)
+			return
 		}
+		state.configs[idx] = updated
+		state.publishConfigs()
 		if err := saveConfigFile(state.configs, configFile); err != nil {
 			dialog.ShowError(err, w)
 			return
 		}
 		state.refreshList()
+		warnExposure(updated, w)
 	}, w)
 	d.Resize(fyne.NewSize(450, 550))
 	d.Show()
@@ -741,28 +735,47 @@ func (state *AppState) deleteSelected(configFile string) {
 		return
 	}
 	idx := state.selectedIdx
-	if rt, exists := state.running[idx]; exists {
-		rt.stop(state)
-		delete(state.running, idx)
+	id := state.configs[idx].ID
+	if _, exists := state.getRunning(id); exists {
+		state.stopTunnel(id)
 	}
 	state.configs = append(state.configs[:idx], state.configs[idx+1:]...)
-	if state.selectedIdx == idx {
-		state.selectedIdx = -1
-	} else if state.selectedIdx > idx {
-		state.selectedIdx--
-	}
-	newRunning := make(map[int]*RunningTunnel)
-	for i, rt := range state.running {
-		if i > idx {
-			newRunning[i-1] = rt
-		} else if i < idx {
-			newRunning[i] = rt
-		}
-	}
-	state.running = newRunning
+	removeDependency(state.configs, id)
+	state.publishConfigs()
+	state.selectedIdx = -1
+	state.list.UnselectAll()
 	if err := saveConfigFile(state.configs, configFile); err != nil {
-		log.Printf("Failed to save config: %v", err)
+		slog.Error("Failed to save config", "err", err)
 	}
 	state.refreshList()
 	state.updateStatus()
 }
+
+// moveSelected shifts the selected tunnel up (delta -1) or down (delta 1).
+// Running state is keyed by tunnel ID, so this is safe while tunnels run.
+func (state *AppState) moveSelected(delta int, configFile string) {
+	idx := state.selectedIdx
+	if idx < 0 || idx >= len(state.configs) {
+		return
+	}
+	to := idx + delta
+	if to < 0 || to >= len(state.configs) {
+		return
+	}
+	state.configs[idx], state.configs[to] = state.configs[to], state.configs[idx]
+	state.publishConfigs()
+	if err := saveConfigFile(state.configs, configFile); err != nil {
+		slog.Error("Failed to save config", "err", err)
+	}
+	state.list.Select(to)
+	state.refreshList()
+}
+
+// otherForwards returns every forward after the first, which the edit
+// dialog does not show.
+func otherForwards(forwards []ForwardConfig) []ForwardConfig {
+	if len(forwards) <= 1 {
+		return nil
+	}
+	return forwards[1:]
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics collects the counters and histograms exported on /metrics in
+// the Prometheus text format. Forward statistics are kept here rather than
+// on RunningTunnel so counters stay monotonic across tunnel restarts.
+var metrics = newMetricsRegistry()
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type forwardMetrics struct {
+	tunnelID string
+	tunnel   string
+	forward  string
+	ftype    string
+	stats    *ForwardStats
+}
+
+func (fm *forwardMetrics) labels() string {
+	return fmt.Sprintf(`tunnel="%s",id="%s",forward="%s",type="%s"`,
+		escapeLabel(fm.tunnel), escapeLabel(fm.tunnelID), escapeLabel(fm.forward), fm.ftype)
+}
+
+type metricsRegistry struct {
+	mu           sync.Mutex
+	forwards     map[string]*forwardMetrics
+	reconnects   map[string]uint64
+	authFailures map[string]uint64
+	handshake    map[string]*histogram
+	dialLatency  map[string]*histogram
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		forwards:     make(map[string]*forwardMetrics),
+		reconnects:   make(map[string]uint64),
+		authFailures: make(map[string]uint64),
+		handshake:    make(map[string]*histogram),
+		dialLatency:  make(map[string]*histogram),
+	}
+}
+
+// forwardStats returns the statistics for each forward of cfg, reusing
+// the ones from an earlier run of the same tunnel and forward.
+func (m *metricsRegistry) forwardStats(cfg TunnelConfig) []*ForwardStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*ForwardStats, len(cfg.Forwards))
+	for i, f := range cfg.Forwards {
+		key := forwardKey(cfg, i, f)
+		fm, ok := m.forwards[key]
+		if !ok {
+			fm = &forwardMetrics{
+				tunnelID: cfg.ID,
+				forward:  forwardAddr(f),
+				ftype:    f.Type.key(),
+				stats:    newForwardStats(),
+			}
+			m.forwards[key] = fm
+		}
+		fm.tunnel = cfg.Name
+		out[i] = fm.stats
+	}
+	return out
+}
+
+// forwardKey identifies the series of one forward. A forward whose type
+// or addresses change starts new series.
+func forwardKey(cfg TunnelConfig, i int, f ForwardConfig) string {
+	return fmt.Sprintf("%s/%d/%d/%s/%s", cfg.ID, i, f.Type, f.LocalAddr, f.RemoteAddr)
+}
+
+// prune drops the series of tunnels and forwards that are neither
+// configured nor running, so deleted, renamed or edited ones stop being
+// exported.
+func (m *metricsRegistry) prune(configs []TunnelConfig, running map[string]*RunningTunnel) {
+	forwards := make(map[string]bool)
+	tunnels := make(map[string]bool)
+	keep := func(cfg TunnelConfig) {
+		tunnels[tunnelLabels(cfg)] = true
+		for i, f := range cfg.Forwards {
+			forwards[forwardKey(cfg, i, f)] = true
+		}
+	}
+	for _, cfg := range configs {
+		keep(cfg)
+	}
+	for _, rt := range running {
+		keep(rt.Cfg)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range m.forwards {
+		if !forwards[k] {
+			delete(m.forwards, k)
+		}
+	}
+	for _, counts := range []map[string]uint64{m.reconnects, m.authFailures} {
+		for k := range counts {
+			if !tunnels[k] {
+				delete(counts, k)
+			}
+		}
+	}
+	for _, hs := range []map[string]*histogram{m.handshake, m.dialLatency} {
+		for k := range hs {
+			if !tunnels[k] {
+				delete(hs, k)
+			}
+		}
+	}
+}
+
+func (m *metricsRegistry) incReconnects(cfg TunnelConfig) {
+	m.mu.Lock()
+	m.reconnects[tunnelLabels(cfg)]++
+	m.mu.Unlock()
+}
+
+func (m *metricsRegistry) incAuthFailures(cfg TunnelConfig) {
+	m.mu.Lock()
+	m.authFailures[tunnelLabels(cfg)]++
+	m.mu.Unlock()
+}
+
+func (m *metricsRegistry) observeHandshake(cfg TunnelConfig, d time.Duration) {
+	m.observe(m.handshake, cfg, d)
+}
+
+func (m *metricsRegistry) observeDial(cfg TunnelConfig, d time.Duration) {
+	m.observe(m.dialLatency, cfg, d)
+}
+
+func (m *metricsRegistry) observe(hs map[string]*histogram, cfg TunnelConfig, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := tunnelLabels(cfg)
+	h, ok := hs[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		hs[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// forwardAddr is the address that identifies a forward in metrics labels.
+func forwardAddr(f ForwardConfig) string {
+	if f.Type == ForwardRemote {
+		return f.RemoteAddr
+	}
+	return f.LocalAddr
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func tunnelLabels(cfg TunnelConfig) string {
+	return fmt.Sprintf(`tunnel="%s",id="%s"`, escapeLabel(cfg.Name), escapeLabel(cfg.ID))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeMetrics renders every metric. configs and running are snapshots
+// taken by the caller.
+func (m *metricsRegistry) writeMetrics(w io.Writer, configs []TunnelConfig, running map[string]*RunningTunnel) {
+	writeHeader(w, "sshtunnel_tunnel_status", "gauge", "Current tunnel status, 1 for the active status.")
+	statuses := []TunnelStatus{StatusStopped, StatusConnecting, StatusConnected, StatusError, StatusDisconnected, StatusIdle}
+	for _, cfg := range configs {
+		current := StatusStopped
+		if rt, ok := running[cfg.ID]; ok {
+			current = rt.Status()
+		}
+		for _, s := range statuses {
+			v := 0
+			if s == current {
+				v = 1
+			}
+			fmt.Fprintf(w, "sshtunnel_tunnel_status{%s,status=\"%s\"} %d\n", tunnelLabels(cfg), strings.ToLower(s.String()), v)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fwdKeys := sortedKeys(m.forwards)
+	forwardSeries := func(name, typ, help string, value func(*ForwardStats) int64) {
+		writeHeader(w, name, typ, help)
+		for _, k := range fwdKeys {
+			fm := m.forwards[k]
+			fmt.Fprintf(w, "%s{%s} %d\n", name, fm.labels(), value(fm.stats))
+		}
+	}
+	writeHeader(w, "sshtunnel_bytes_total", "counter", "Bytes forwarded, by direction relative to the client.")
+	for _, k := range fwdKeys {
+		fm := m.forwards[k]
+		labels := fm.labels()
+		fmt.Fprintf(w, "sshtunnel_bytes_total{%s,direction=\"in\"} %d\n", labels, fm.stats.BytesIn.Load())
+		fmt.Fprintf(w, "sshtunnel_bytes_total{%s,direction=\"out\"} %d\n", labels, fm.stats.BytesOut.Load())
+	}
+	forwardSeries("sshtunnel_connections_total", "counter", "Connections accepted.",
+		func(fs *ForwardStats) int64 { return fs.Total.Load() })
+	forwardSeries("sshtunnel_active_connections", "gauge", "Connections currently open.",
+		func(fs *ForwardStats) int64 { return fs.Active.Load() })
+	forwardSeries("sshtunnel_dial_errors_total", "counter", "Failed dials to the forward target.",
+		func(fs *ForwardStats) int64 { return fs.DialFailures.Load() })
+	forwardSeries("sshtunnel_blocked_total", "counter", "SOCKS requests refused by destination rules.",
+		func(fs *ForwardStats) int64 { return fs.Blocked.Load() })
+
+	writeHeader(w, "sshtunnel_reconnects_total", "counter", "Restarts of a tunnel after it was disconnected or failed.")
+	for _, k := range sortedKeys(m.reconnects) {
+		fmt.Fprintf(w, "sshtunnel_reconnects_total{%s} %d\n", k, m.reconnects[k])
+	}
+	writeHeader(w, "sshtunnel_auth_failures_total", "counter", "SSH authentication failures.")
+	for _, k := range sortedKeys(m.authFailures) {
+		fmt.Fprintf(w, "sshtunnel_auth_failures_total{%s} %d\n", k, m.authFailures[k])
+	}
+
+	writeHistograms(w, "sshtunnel_ssh_handshake_seconds", "Time to establish and authenticate the SSH connection.", m.handshake)
+	writeHistograms(w, "sshtunnel_dial_latency_seconds", "Time for the SSH server to open a forwarded connection.", m.dialLatency)
+}
+
+func writeHistograms(w io.Writer, name, help string, hs map[string]*histogram) {
+	writeHeader(w, name, "histogram", help)
+	for _, k := range sortedKeys(hs) {
+		h := hs[k]
+		var cum uint64
+		for i, b := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, k, b, cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, k, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, k, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, k, h.count)
+	}
+}
+
+// publishConfigs copies state.configs, which belongs to the UI goroutine,
+// for the HTTP handlers. Waiting on the UI from a handler would stall
+// quitting, which shuts the server down from the UI goroutine. Call it
+// on the UI goroutine whenever configs changes.
+func (state *AppState) publishConfigs() {
+	cfgs := append([]TunnelConfig(nil), state.configs...)
+	state.snapMu.Lock()
+	state.snapCfg = cfgs
+	state.snapMu.Unlock()
+}
+
+func (state *AppState) configsSnapshot() []TunnelConfig {
+	state.snapMu.Lock()
+	defer state.snapMu.Unlock()
+	return state.snapCfg
+}
+
+func (state *AppState) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	configs := state.configsSnapshot()
+	running := state.runningTunnels()
+	metrics.prune(configs, running)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.writeMetrics(w, configs, running)
+}
+
+// statusForward and statusTunnel are the JSON served on /status.
+type statusForward struct {
+	Type       string `json:"type"`
+	LocalAddr  string `json:"local_addr"`
+	RemoteAddr string `json:"remote_addr"`
+	BoundAddr  string `json:"bound_addr,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type statusTunnel struct {
+	ID       string          `json:"id"`
+	Name     string          `json:"name"`
+	Status   string          `json:"status"`
+	Error    string          `json:"error,omitempty"`
+	Forwards []statusForward `json:"forwards"`
+}
+
+// handleStatus serves every tunnel's status and the addresses its
+// forwards are bound to, so scripts can find allocated ports.
+func (state *AppState) handleStatus(w http.ResponseWriter, r *http.Request) {
+	configs := state.configsSnapshot()
+	running := state.runningTunnels()
+	out := make([]statusTunnel, 0, len(configs))
+	for _, cfg := range configs {
+		st := statusTunnel{ID: cfg.ID, Name: cfg.Name, Status: strings.ToLower(StatusStopped.String())}
+		forwards := cfg.Forwards
+		rt, ok := running[cfg.ID]
+		if ok {
+			st.Status = strings.ToLower(rt.Status().String())
+			st.Error = rt.ErrorMsg()
+			forwards = rt.Cfg.Forwards
+		}
+		for i, f := range forwards {
+			sf := statusForward{Type: f.Type.key(), LocalAddr: f.LocalAddr, RemoteAddr: f.RemoteAddr}
+			if ok {
+				sf.BoundAddr = rt.boundAddr(i)
+				sf.Error = rt.forwardErr(i)
+			}
+			st.Forwards = append(st.Forwards, sf)
+		}
+		out = append(out, st)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		slog.Debug("Failed to write status", "err", err)
+	}
+}
+
+// restartMetricsServer stops the current /metrics listener, if any, and
+// starts a new one on addr unless addr is empty. It fails if addr can't
+// be listened on.
+func (state *AppState) restartMetricsServer(addr string) error {
+	if state.metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		state.metricsServer.Shutdown(ctx)
+		cancel()
+		state.metricsServer = nil
+	}
+	if addr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("Metrics listener failed", "addr", addr, "err", err)
+		return fmt.Errorf("metrics listener on %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", state.handleMetrics)
+	mux.HandleFunc("/status", state.handleStatus)
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	state.metricsServer = srv
+	safeGo(func() {
+		slog.Info("Serving metrics", "url", "http://"+addr+"/metrics")
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("Metrics server failed", "addr", addr, "err", err)
+		}
+	})
+	return nil
+}
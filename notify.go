@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+)
+
+// A tunnel may send notifyBurst notifications per notifyWindow; further
+// ones are dropped and counted in the next one that gets through.
+const (
+	notifyBurst  = 3
+	notifyWindow = time.Minute
+)
+
+// notifier turns tunnel events into desktop notifications. Its fields are
+// only touched on the UI goroutine.
+type notifier struct {
+	app        fyne.App
+	state      *AppState
+	sent       map[string][]time.Time
+	suppressed map[string]int
+	lost       map[string]bool // lost a working connection, next connect is a reconnect
+}
+
+func (state *AppState) subscribeNotifications(a fyne.App) {
+	n := &notifier{
+		app:        a,
+		state:      state,
+		sent:       make(map[string][]time.Time),
+		suppressed: make(map[string]int),
+		lost:       make(map[string]bool),
+	}
+	events, _ := state.events.subscribe()
+	safeGo(func() {
+		for ev := range events {
+			fyne.Do(func() { n.handle(ev) })
+		}
+	})
+}
+
+func (n *notifier) handle(ev TunnelEvent) {
+	var what string
+	switch ev.To {
+	case StatusConnected:
+		if ev.From == StatusConnected {
+			// A forward failed while the others keep running
+			what = "lost a forward"
+			break
+		}
+		if n.onDemand(ev.TunnelID) {
+			// Routine for on-demand tunnels
+			return
+		}
+		if n.lost[ev.TunnelID] {
+			delete(n.lost, ev.TunnelID)
+			what = "reconnected"
+		} else {
+			what = "connected"
+		}
+	case StatusDisconnected:
+		n.lost[ev.TunnelID] = true
+		what = "disconnected"
+	case StatusError:
+		switch {
+		case isAuthErrorMsg(ev.ErrorMsg):
+			what = "authentication failed"
+		case ev.From == StatusConnected:
+			n.lost[ev.TunnelID] = true
+			what = "disconnected"
+		default:
+			what = "failed to start"
+		}
+	case StatusIdle:
+		// An on-demand connect that failed
+		if ev.From != StatusConnecting || ev.ErrorMsg == "" {
+			return
+		}
+		if isAuthErrorMsg(ev.ErrorMsg) {
+			what = "authentication failed"
+		} else {
+			what = "failed to connect"
+		}
+	case StatusStopped:
+		// Stopped by the user; the next connect is a fresh start
+		if ev.From == StatusConnected {
+			delete(n.lost, ev.TunnelID)
+		}
+		return
+	default:
+		return
+	}
+
+	if idx := n.state.configIndex(ev.TunnelID); idx >= 0 && n.state.configs[idx].MuteNotifications {
+		return
+	}
+	if !n.allow(ev.TunnelID) {
+		slog.Debug("Notification rate limited", "tunnel", ev.TunnelID, "event", what)
+		return
+	}
+	content := ev.ErrorMsg
+	if count := n.suppressed[ev.TunnelID]; count > 0 {
+		content = strings.TrimSpace(fmt.Sprintf("%s (%d earlier notifications suppressed)", content, count))
+		delete(n.suppressed, ev.TunnelID)
+	}
+	n.app.SendNotification(fyne.NewNotification(fmt.Sprintf("%s %s", ev.Name, what), content))
+}
+
+func (n *notifier) onDemand(id string) bool {
+	idx := n.state.configIndex(id)
+	return idx >= 0 && n.state.configs[idx].OnDemand
+}
+
+// allow records a notification for the tunnel unless it has used up its
+// burst for the current window.
+func (n *notifier) allow(id string) bool {
+	now := time.Now()
+	recent := n.sent[id][:0]
+	for _, t := range n.sent[id] {
+		if now.Sub(t) < notifyWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= notifyBurst {
+		n.sent[id] = recent
+		n.suppressed[id]++
+		return false
+	}
+	n.sent[id] = append(recent, now)
+	return true
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultIdleTimeout = 5 * time.Minute
+
+func (rt *RunningTunnel) idleTimeout() time.Duration {
+	if rt.Cfg.IdleTimeout > 0 {
+		return time.Duration(rt.Cfg.IdleTimeout) * time.Second
+	}
+	return defaultIdleTimeout
+}
+
+// activeConnections counts open client connections over all forwards and
+// those the router sends through the tunnel.
+func (rt *RunningTunnel) activeConnections() int64 {
+	n := rt.routed.Load()
+	for _, fs := range rt.stats {
+		n += fs.Active.Load()
+	}
+	return n
+}
+
+// acquireClient returns the SSH client for a new forwarded connection. An
+// on-demand tunnel that is Idle connects first; concurrent callers wait
+// for that connect rather than starting their own. Callers count as
+// active connections before asking, so goIdle, which also holds dialMu,
+// won't close the client under them.
+func (rt *RunningTunnel) acquireClient() (*ssh.Client, error) {
+	if !rt.Cfg.OnDemand {
+		if c := rt.sshClient(); c != nil {
+			return c, nil
+		}
+		return nil, errors.New("SSH client is nil")
+	}
+	rt.dialMu.Lock()
+	defer rt.dialMu.Unlock()
+	if c := rt.sshClient(); c != nil {
+		return c, nil
+	}
+	if !rt.transitionFrom(StatusIdle, StatusConnecting, "") {
+		return nil, fmt.Errorf("tunnel is %s", rt.Status())
+	}
+	state := rt.state
+
+	code := ""
+	if rt.Cfg.Auth.Use2FA && !state.hasSSHConnection(rt.Cfg) {
+		var ok bool
+		if code, ok = state.promptTwoFA(rt.Cfg); !ok {
+			rt.transitionFrom(StatusConnecting, StatusIdle, "2FA prompt cancelled")
+			return nil, errors.New("2FA prompt cancelled")
+		}
+	}
+	client, err := state.getSSHConnection(rt.Cfg, code)
+	if err != nil {
+		rt.log.Error("On-demand connect failed", "err", err)
+		if isAuthError(err) {
+			metrics.incAuthFailures(rt.Cfg)
+		}
+		rt.transitionFrom(StatusConnecting, StatusIdle, err.Error())
+		return nil, err
+	}
+	rt.setSSHClient(client)
+	if !rt.transitionFrom(StatusConnecting, StatusConnected, "") {
+		// Stopped while connecting
+		state.releaseSSHConnection(rt)
+		return nil, fmt.Errorf("tunnel is %s", rt.Status())
+	}
+	rt.touch()
+	rt.log.Info("Connected on demand", "ssh", connectionKey(rt.Cfg))
+	return client, nil
+}
+
+// idleMonitor drops the SSH connection of an on-demand tunnel once it has
+// had no client connections for the idle timeout.
+func (rt *RunningTunnel) idleMonitor(stopped <-chan struct{}) {
+	defer rt.wg.Done()
+	timeout := rt.idleTimeout()
+	interval := timeout / 4
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastActive := time.Now()
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-ticker.C:
+		}
+		if rt.Status() != StatusConnected || rt.activeConnections() > 0 {
+			lastActive = time.Now()
+			continue
+		}
+		if time.Since(lastActive) >= timeout {
+			rt.goIdle("")
+			lastActive = time.Now()
+		}
+	}
+}
+
+// goIdle tears down the SSH connection of a connected on-demand tunnel
+// while keeping its listeners, unless a client connected in the meantime.
+func (rt *RunningTunnel) goIdle(reason string) {
+	rt.dialMu.Lock()
+	defer rt.dialMu.Unlock()
+	if reason == "" && rt.activeConnections() > 0 {
+		return
+	}
+	if !rt.transitionFrom(StatusConnected, StatusIdle, reason) {
+		return
+	}
+	rt.log.Info("Going idle, closing SSH connection", "reason", reason)
+	rt.state.releaseSSHConnection(rt)
+}
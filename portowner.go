@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+)
+
+// portOwner is the process listening on a port.
+type portOwner struct {
+	PID int
+	Exe string
+}
+
+// isOtherInstance reports whether the owner runs the very same executable
+// file as this process but is not this process. A matching name is not
+// enough, as it is all the user is shown before the owner gets stopped.
+func (o *portOwner) isOtherInstance() bool {
+	if o.PID == os.Getpid() {
+		return false
+	}
+	return runsOwnExecutable(o.PID)
+}
+
+// portInUseError is a listen failure on a busy port, with what is known
+// about who holds it.
+type portInUseError struct {
+	addr   string
+	owner  *portOwner
+	tunnel *RunningTunnel // the holder, if it is a tunnel of this app
+	err    error
+}
+
+func (e *portInUseError) Error() string {
+	switch {
+	case e.tunnel != nil:
+		return fmt.Sprintf("port %s is held by tunnel %s in this app (%s)", e.addr, e.tunnel.Cfg.Name, e.tunnel.Status())
+	case e.owner != nil && e.owner.PID == os.Getpid():
+		return fmt.Sprintf("port %s is already used by this app", e.addr)
+	case e.owner != nil && e.owner.isOtherInstance():
+		return fmt.Sprintf("port %s is held by another instance of this app (pid %d)", e.addr, e.owner.PID)
+	case e.owner != nil:
+		return fmt.Sprintf("port %s is in use by pid %d (%s)", e.addr, e.owner.PID, e.owner.Exe)
+	}
+	return fmt.Sprintf("port %s is in use: %v", e.addr, e.err)
+}
+
+func (e *portInUseError) Unwrap() error { return e.err }
+
+// canStop reports whether the holder is something the user may stop from
+// here: a tunnel of this app or another instance.
+func (e *portInUseError) canStop() bool {
+	return e.tunnel != nil || (e.owner != nil && e.owner.isOtherInstance())
+}
+
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || strings.Contains(err.Error(), "address already in use")
+}
+
+// portInUse explains a listen failure on addr. Errors other than a busy
+// port are returned unchanged.
+func (rt *RunningTunnel) portInUse(addr string, err error) error {
+	if !isAddrInUse(err) {
+		return err
+	}
+	e := &portInUseError{addr: addr, err: err}
+	_, portStr, _ := net.SplitHostPort(addr)
+	port, convErr := strconv.Atoi(portStr)
+	if convErr != nil {
+		return e
+	}
+	owner, lookupErr := findPortOwner(port)
+	if lookupErr != nil {
+		rt.log.Debug("Could not find the process holding the port", "addr", addr, "err", lookupErr)
+		return e
+	}
+	e.owner = owner
+	if owner.PID == os.Getpid() && rt.state != nil {
+		e.tunnel = rt.state.tunnelOnPort(rt, portStr)
+	}
+	return e
+}
+
+// tunnelOnPort returns the running tunnel other than self with a forward
+// bound to port.
+func (state *AppState) tunnelOnPort(self *RunningTunnel, port string) *RunningTunnel {
+	for _, other := range state.runningTunnels() {
+		if other == self {
+			continue
+		}
+		for i, f := range other.Cfg.Forwards {
+			if f.Type == ForwardRemote {
+				continue
+			}
+			if _, p, err := net.SplitHostPort(other.boundAddr(i)); err == nil && p == port {
+				return other
+			}
+		}
+	}
+	return nil
+}
+
+// offerStopPortOwner asks whether to stop whatever holds the port rt
+// needs and, if so, stops it and starts rt again. Must run on the UI
+// goroutine.
+func (state *AppState) offerStopPortOwner(rt *RunningTunnel, e *portInUseError) {
+	what := fmt.Sprintf("another instance of this app (pid %d)", e.owner.PID)
+	if e.tunnel != nil {
+		what = fmt.Sprintf("the tunnel %s", e.tunnel.Cfg.Name)
+	}
+	msg := fmt.Sprintf("%s could not start because port %s is held by %s.\n\nStop it and try again?", rt.Cfg.Name, e.addr, what)
+	dialog.ShowConfirm("Port In Use", msg, func(ok bool) {
+		if !ok {
+			return
+		}
+		if e.tunnel != nil {
+			state.stopTunnel(e.tunnel.Cfg.ID)
+			state.startTunnel(rt.Cfg.ID, state.window)
+			return
+		}
+		// The pid may have been reused while the dialog was open
+		if !e.owner.isOtherInstance() {
+			dialog.ShowError(fmt.Errorf("pid %d is no longer another instance of this app", e.owner.PID), state.window)
+			return
+		}
+		rt.log.Info("Stopping other instance holding port", "addr", e.addr, "pid", e.owner.PID)
+		if err := stopProcess(e.owner.PID); err != nil {
+			dialog.ShowError(fmt.Errorf("stop pid %d: %w", e.owner.PID, err), state.window)
+			return
+		}
+		// Give it a moment to release its listeners
+		safeGo(func() {
+			time.Sleep(time.Second)
+			fyne.Do(func() { state.startTunnel(rt.Cfg.ID, state.window) })
+		})
+	}, state.window)
+}
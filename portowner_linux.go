@@ -0,0 +1,107 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// findPortOwner looks up the listening socket for port in /proc/net/tcp
+// and tcp6, then the process that has it open in /proc/*/fd. Processes of
+// other users can't be inspected without privileges.
+func findPortOwner(port int) (*portOwner, error) {
+	inodes := make(map[string]bool)
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if err := listenInodes(table, port, inodes); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if len(inodes) == 0 {
+		return nil, fmt.Errorf("no listening socket on port %d", port)
+	}
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil {
+				continue
+			}
+			inode, ok := strings.CutPrefix(link, "socket:[")
+			if ok && inodes[strings.TrimSuffix(inode, "]")] {
+				return &portOwner{PID: pid, Exe: processExe(pid)}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("port %d is held by a process that can't be inspected", port)
+}
+
+// listenInodes adds the inodes of sockets listening on port in one
+// /proc/net table.
+func listenInodes(table string, port int, inodes map[string]bool) error {
+	f, err := os.Open(table)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	want := fmt.Sprintf(":%04X", port)
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		// sl local_address rem_address st ... inode
+		if len(fields) < 10 || fields[3] != "0A" || !strings.HasSuffix(fields[1], want) {
+			continue
+		}
+		inodes[fields[9]] = true
+	}
+	return sc.Err()
+}
+
+func processExe(pid int) string {
+	if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
+		return strings.TrimSuffix(exe, " (deleted)")
+	}
+	if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+		return strings.TrimSpace(string(comm))
+	}
+	return ""
+}
+
+// runsOwnExecutable reports whether pid runs the same file as this
+// process. An executable replaced since pid started doesn't count.
+func runsOwnExecutable(pid int) bool {
+	self, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	selfInfo, err := os.Stat(self)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(fmt.Sprintf("/proc/%d/exe", pid))
+	return err == nil && os.SameFile(selfInfo, info)
+}
+
+// stopProcess asks another instance to exit.
+func stopProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
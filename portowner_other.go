@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func findPortOwner(port int) (*portOwner, error) {
+	return nil, errors.New("finding the process holding a port is only supported on Linux")
+}
+
+func runsOwnExecutable(pid int) bool {
+	return false
+}
+
+func stopProcess(pid int) error {
+	return errors.New("stopping other processes is only supported on Linux")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// autoPort in a LocalAddr asks for the first free port of the forward's
+// port range; port 0 lets the OS pick any free port.
+const autoPort = "auto"
+
+const defaultPortRange = "20000-29999"
+
+// parsePortRange reads "lo-hi", falling back to defaultPortRange.
+func parsePortRange(s string) (lo, hi int, err error) {
+	if s == "" {
+		s = defaultPortRange
+	}
+	ranges, err := parsePorts(s)
+	if err != nil || len(ranges) != 1 {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return ranges[0].lo, ranges[0].hi, nil
+}
+
+// isAutoAddr reports whether addr leaves the port to be allocated.
+func isAutoAddr(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && (port == autoPort || port == "0")
+}
+
+// listenForward binds a forward's LocalAddr, allocating the port when it
+// is "auto" or 0.
+func listenForward(f ForwardConfig) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(f.LocalAddr)
+	if err != nil || port != autoPort {
+		return net.Listen("tcp", f.LocalAddr)
+	}
+	lo, hi, err := parsePortRange(f.PortRange)
+	if err != nil {
+		return nil, err
+	}
+	for p := lo; p <= hi; p++ {
+		if ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(p))); err == nil {
+			return ln, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in range %d-%d on %s", lo, hi, host)
+}
+
+// setBound records the address forward i actually listens on.
+func (rt *RunningTunnel) setBound(i int, addr string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.bound == nil {
+		rt.bound = make([]string, len(rt.Cfg.Forwards))
+	}
+	rt.bound[i] = addr
+}
+
+// boundAddr returns the address forward i listens on, or "" if it isn't
+// listening locally.
+func (rt *RunningTunnel) boundAddr(i int) string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if i < len(rt.bound) {
+		return rt.bound[i]
+	}
+	return ""
+}
+
+// allocatedPorts lists the bound addresses of forwards whose port was
+// allocated at start, by this machine or the server, for the tunnel list.
+func (rt *RunningTunnel) allocatedPorts() string {
+	var addrs []string
+	for i, f := range rt.Cfg.Forwards {
+		if bound := rt.boundAddr(i); bound != "" && isAutoAddr(f.listenAddr()) {
+			addrs = append(addrs, bound)
+		}
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// envName turns a tunnel name into the stem of an environment variable.
+func envName(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToUpper(name) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	return strings.Trim(sb.String(), "_")
+}
+
+// portsEnv renders the bound addresses of running tunnels as shell
+// variables, SSHTUNNEL_<NAME>_<N>_ADDR and _PORT with N counting forwards
+// from 1.
+func portsEnv(running map[string]*RunningTunnel) string {
+	var lines []string
+	for _, rt := range running {
+		if !rt.Status().isUp() {
+			continue
+		}
+		stem := "SSHTUNNEL_" + envName(rt.Cfg.Name)
+		for i := range rt.Cfg.Forwards {
+			addr := rt.boundAddr(i)
+			if addr == "" {
+				continue
+			}
+			_, port, _ := net.SplitHostPort(addr)
+			lines = append(lines,
+				fmt.Sprintf("%s_%d_ADDR=%s", stem, i+1, addr),
+				fmt.Sprintf("%s_%d_PORT=%s", stem, i+1, port))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// writePortsEnv rewrites the ports env file, if one is configured. Must
+// run on the UI goroutine.
+func (state *AppState) writePortsEnv() {
+	path := portsEnvPath(state.settings.PortsEnvFile)
+	if path == "" {
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(portsEnv(state.runningTunnels())), 0644); err != nil {
+		slog.Error("Failed to write ports env file", "path", path, "err", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		slog.Error("Failed to write ports env file", "path", path, "err", err)
+	}
+}
+
+// subscribePortsEnv keeps the ports env file current as tunnels start and
+// stop.
+func (state *AppState) subscribePortsEnv() {
+	events, _ := state.events.subscribe()
+	safeGo(func() {
+		for range events {
+			state.onUI(state.writePortsEnv)
+		}
+	})
+}
+
+// portsEnvPath expands a leading ~ in the configured env file path.
+func portsEnvPath(s string) string {
+	if rest, ok := strings.CutPrefix(s, "~"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return s
+}
@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		lo, hi  int
+		wantErr bool
+	}{
+		{"", 20000, 29999, false},
+		{"3000-3010", 3000, 3010, false},
+		{"8080", 8080, 8080, false},
+		{"3000-3010,4000-4010", 0, 0, true},
+		{"3010-3000", 0, 0, true},
+		{"auto", 0, 0, true},
+	}
+	for _, tt := range tests {
+		lo, hi, err := parsePortRange(tt.in)
+		if (err != nil) != tt.wantErr || lo != tt.lo || hi != tt.hi {
+			t.Errorf("parsePortRange(%q) = %d, %d, %v, want %d, %d, error %v", tt.in, lo, hi, err, tt.lo, tt.hi, tt.wantErr)
+		}
+	}
+}
+
+func TestIsAutoAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:auto", true},
+		{"127.0.0.1:0", true},
+		{"[::1]:auto", true},
+		{"127.0.0.1:8080", false},
+		{"auto", false},
+	}
+	for _, tt := range tests {
+		if got := isAutoAddr(tt.addr); got != tt.want {
+			t.Errorf("isAutoAddr(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"web", "WEB"},
+		{"Prod DB (eu-1)", "PROD_DB__EU_1"},
+		{"  staging  ", "STAGING"},
+		{"Café 2", "CAF__2"},
+	}
+	for _, tt := range tests {
+		if got := envName(tt.name); got != tt.want {
+			t.Errorf("envName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPortsEnv(t *testing.T) {
+	up := testTunnel("a")
+	up.Name = "Prod DB"
+	up.Forwards = append(up.Forwards, ForwardConfig{Type: ForwardDynamic, LocalAddr: "127.0.0.1:auto"})
+	upRT := newRunningTunnel(up, nil)
+	upRT.transition(StatusConnecting, "")
+	upRT.transition(StatusConnected, "")
+	upRT.setBound(0, "127.0.0.1:8080")
+	upRT.setBound(1, "127.0.0.1:20001")
+
+	down := testTunnel("b")
+	downRT := newRunningTunnel(down, nil)
+	downRT.setBound(0, "127.0.0.1:9090")
+
+	want := "SSHTUNNEL_PROD_DB_1_ADDR=127.0.0.1:8080\n" +
+		"SSHTUNNEL_PROD_DB_1_PORT=8080\n" +
+		"SSHTUNNEL_PROD_DB_2_ADDR=127.0.0.1:20001\n" +
+		"SSHTUNNEL_PROD_DB_2_PORT=20001\n"
+	if got := portsEnv(map[string]*RunningTunnel{"a": upRT, "b": downRT}); got != want {
+		t.Errorf("portsEnv() =\n%s\nwant\n%s", got, want)
+	}
+	if got := upRT.allocatedPorts(); got != "127.0.0.1:20001" {
+		t.Errorf("allocatedPorts() = %q, want only the auto forward", got)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"golang.org/x/term"
+)
+
+// loginPrompter asks the user what the server wants to know during a
+// keyboard-interactive login, and keeps answers the user chose to have
+// remembered. Only answers to prompts shown in the clear are remembered.
+type loginPrompter struct {
+	ask      func(name, instruction string, questions []string, echos []bool) (answers []string, remember bool, err error)
+	recall   func(pattern string) (string, bool)
+	remember func(pattern, answer string)
+}
+
+// kbdAuth answers the keyboard-interactive rounds of one login. Password
+// and 2FA code prompts are answered from the tunnel's settings, others
+// from remembered answers or by asking.
+type kbdAuth struct {
+	password string
+	code     string
+	codeUsed bool
+	prompt   *loginPrompter
+}
+
+// promptPattern is the key a prompt's answer is remembered under.
+func promptPattern(q string) string {
+	return strings.Join(strings.Fields(strings.ToLower(q)), " ")
+}
+
+func isCodePrompt(ql string) bool {
+	for _, w := range []string{"verification", "code", "token", "authenticator"} {
+		if strings.Contains(ql, w) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *kbdAuth) challenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	var ask []int
+	for i, q := range questions {
+		ql := strings.ToLower(strings.TrimSpace(q))
+		switch {
+		case strings.Contains(ql, "password") && k.password != "":
+			answers[i] = k.password
+		case isCodePrompt(ql) && k.code != "" && !k.codeUsed:
+			// A one-time code is no good for a second round
+			answers[i] = k.code
+			k.codeUsed = true
+		default:
+			if k.prompt != nil && echos[i] {
+				if a, ok := k.prompt.recall(promptPattern(q)); ok {
+					answers[i] = a
+					continue
+				}
+			}
+			ask = append(ask, i)
+		}
+	}
+	if len(ask) == 0 {
+		return answers, nil
+	}
+	if k.prompt == nil {
+		return nil, fmt.Errorf("unexpected prompt: %s", questions[ask[0]])
+	}
+	qs := make([]string, len(ask))
+	es := make([]bool, len(ask))
+	for j, i := range ask {
+		qs[j], es[j] = questions[i], echos[i]
+	}
+	got, remember, err := k.prompt.ask(name, instruction, qs, es)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range ask {
+		answers[i] = got[j]
+		if remember && echos[i] {
+			k.prompt.remember(promptPattern(questions[i]), got[j])
+		}
+	}
+	return answers, nil
+}
+
+// prompter asks in a dialog, or on the terminal when running headless,
+// and remembers answers per server in settings.json.
+func (state *AppState) prompter(cfg TunnelConfig) *loginPrompter {
+	key := connectionKey(cfg)
+	p := &loginPrompter{
+		recall: func(pattern string) (a string, ok bool) {
+			state.onUI(func() {
+				a, ok = state.settings.PromptAnswers[key][pattern]
+			})
+			return a, ok
+		},
+		remember: func(pattern, answer string) {
+			state.onUI(func() {
+				if state.settings.PromptAnswers == nil {
+					state.settings.PromptAnswers = make(map[string]map[string]string)
+				}
+				if state.settings.PromptAnswers[key] == nil {
+					state.settings.PromptAnswers[key] = make(map[string]string)
+				}
+				state.settings.PromptAnswers[key][pattern] = answer
+				if err := saveSettings(state.settings, state.settingsFile); err != nil {
+					slog.Error("Failed to save remembered login answer", "ssh", key, "err", err)
+				}
+			})
+		},
+	}
+	if state.headless {
+		p.ask = terminalAsk
+	} else {
+		p.ask = func(name, instruction string, questions []string, echos []bool) ([]string, bool, error) {
+			return state.askLogin(cfg, name, instruction, questions, echos)
+		}
+	}
+	return p
+}
+
+// askLogin shows the server's prompts in a dialog and waits for the
+// answers. It must not be called on the UI goroutine.
+func (state *AppState) askLogin(cfg TunnelConfig, name, instruction string, questions []string, echos []bool) ([]string, bool, error) {
+	type reply struct {
+		answers  []string
+		remember bool
+		ok       bool
+	}
+	ch := make(chan reply, 1)
+	fyne.Do(func() {
+		var items []*widget.FormItem
+		if instruction = strings.TrimSpace(instruction); instruction != "" {
+			lbl := widget.NewLabel(instruction)
+			lbl.Wrapping = fyne.TextWrapWord
+			items = append(items, widget.NewFormItem("", lbl))
+		}
+		entries := make([]*widget.Entry, len(questions))
+		canRemember := false
+		for i, q := range questions {
+			if echos[i] {
+				entries[i] = widget.NewEntry()
+				canRemember = true
+			} else {
+				entries[i] = widget.NewPasswordEntry()
+			}
+			items = append(items, widget.NewFormItem(strings.TrimSpace(q), entries[i]))
+		}
+		rememberCheck := widget.NewCheck("Remember visible answers for this server", nil)
+		if canRemember {
+			items = append(items, widget.NewFormItem("", rememberCheck))
+		}
+		title := "Login: " + cfg.Name
+		if name != "" {
+			title += " (" + name + ")"
+		}
+		state.window.Show()
+		state.window.RequestFocus()
+		d := dialog.NewForm(title, "Submit", "Cancel", items, func(ok bool) {
+			answers := make([]string, len(entries))
+			for i, e := range entries {
+				answers[i] = e.Text
+			}
+			ch <- reply{answers, rememberCheck.Checked, ok}
+		}, state.window)
+		d.Resize(fyne.NewSize(420, d.MinSize().Height))
+		d.Show()
+	})
+	r := <-ch
+	if !r.ok {
+		return nil, false, errors.New("login prompt cancelled")
+	}
+	return r.answers, r.remember, nil
+}
+
+// terminalMu keeps prompts of concurrent logins from interleaving.
+// Lines are read through one reader so none are lost between prompts.
+var (
+	terminalMu sync.Mutex
+	terminalIn = bufio.NewReader(os.Stdin)
+)
+
+// terminalAsk asks on the terminal, hiding the typing of prompts the
+// server marked as secret.
+func terminalAsk(name, instruction string, questions []string, echos []bool) ([]string, bool, error) {
+	terminalMu.Lock()
+	defer terminalMu.Unlock()
+	for _, s := range []string{name, instruction} {
+		if s = strings.TrimSpace(s); s != "" {
+			fmt.Fprintln(os.Stderr, s)
+		}
+	}
+	answers, err := readTerminalAnswers(questions, echos)
+	if err != nil {
+		return nil, false, err
+	}
+	canRemember := false
+	for _, echo := range echos {
+		canRemember = canRemember || echo
+	}
+	if !canRemember {
+		return answers, false, nil
+	}
+	fmt.Fprint(os.Stderr, "Remember visible answers for this server? [y/N] ")
+	yes, err := readTerminalLine()
+	if err != nil {
+		return answers, false, nil
+	}
+	yes = strings.ToLower(strings.TrimSpace(yes))
+	return answers, yes == "y" || yes == "yes", nil
+}
+
+// readTerminalAnswers asks each question in turn. The caller holds
+// terminalMu.
+func readTerminalAnswers(questions []string, echos []bool) ([]string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("the server asked for input but there is no terminal to ask on")
+	}
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		fmt.Fprint(os.Stderr, q)
+		var err error
+		if echos[i] {
+			answers[i], err = readTerminalLine()
+		} else {
+			var b []byte
+			b, err = term.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			answers[i] = string(b)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read answer: %w", err)
+		}
+	}
+	return answers, nil
+}
+
+func readTerminalLine() (string, error) {
+	line, err := terminalIn.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
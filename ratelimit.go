@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket holding up to one second of traffic.
+// Callers take tokens before writing and sleep off any debt, so
+// connections sharing a limiter split its rate between them.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for kibPerSec KiB/s, or nil when the
+// limit is zero, meaning unlimited.
+func newRateLimiter(kibPerSec int) *rateLimiter {
+	if kibPerSec <= 0 {
+		return nil
+	}
+	rate := float64(kibPerSec) * 1024
+	return &rateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// reserve takes n bytes' worth of tokens and returns how long the caller
+// must wait before sending them.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// chunk is the largest write that fits in a quarter second at this rate,
+// so a slow limit doesn't hold back a whole copy buffer at once.
+func (l *rateLimiter) chunk() int {
+	return max(1024, int(l.rate/4))
+}
+
+// throttledWriter writes through every non-nil limiter in limiters, e.g.
+// one per forward and one for the whole tunnel.
+type throttledWriter struct {
+	w        io.Writer
+	limiters []*rateLimiter
+}
+
+// throttle wraps w when any limiter applies.
+func throttle(w io.Writer, limiters ...*rateLimiter) io.Writer {
+	tw := throttledWriter{w: w}
+	for _, l := range limiters {
+		if l != nil {
+			tw.limiters = append(tw.limiters, l)
+		}
+	}
+	if len(tw.limiters) == 0 {
+		return w
+	}
+	return tw
+}
+
+func (tw throttledWriter) Write(p []byte) (int, error) {
+	size := len(p)
+	for _, l := range tw.limiters {
+		size = min(size, l.chunk())
+	}
+	written := 0
+	for written < len(p) {
+		part := p[written:min(written+size, len(p))]
+		var wait time.Duration
+		for _, l := range tw.limiters {
+			wait = max(wait, l.reserve(len(part)))
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		n, err := tw.w.Write(part)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// throughput returns the forward's average rates in bytes per second over
+// the interval between the last two samples at least half a second apart.
+func (fs *ForwardStats) throughput() (in, out float64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	now := time.Now()
+	bytesIn, bytesOut := fs.BytesIn.Load(), fs.BytesOut.Load()
+	if fs.rateAt.IsZero() {
+		fs.rateAt, fs.rateIn, fs.rateOut = now, bytesIn, bytesOut
+		return fs.lastIn, fs.lastOut
+	}
+	if elapsed := now.Sub(fs.rateAt).Seconds(); elapsed >= 0.5 {
+		fs.lastIn = float64(bytesIn-fs.rateIn) / elapsed
+		fs.lastOut = float64(bytesOut-fs.rateOut) / elapsed
+		fs.rateAt, fs.rateIn, fs.rateOut = now, bytesIn, bytesOut
+	}
+	return fs.lastIn, fs.lastOut
+}
+
+func formatRate(bytesPerSec float64) string {
+	return formatBytes(int64(bytesPerSec)) + "/s"
+}
+
+// formatLimits describes configured limits in KiB/s as a suffix for the
+// throughput line, or "" when there are none.
+func formatLimits(upload, download int) string {
+	var parts []string
+	if upload > 0 {
+		parts = append(parts, fmt.Sprintf("up %d KiB/s", upload))
+	}
+	if download > 0 {
+		parts = append(parts, fmt.Sprintf("down %d KiB/s", download))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (limit " + strings.Join(parts, ", ") + ")"
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	for _, kib := range []int{0, -5} {
+		if l := newRateLimiter(kib); l != nil {
+			t.Errorf("newRateLimiter(%d) = %+v, want nil for unlimited", kib, l)
+		}
+	}
+	if l := newRateLimiter(2); l == nil || l.rate != 2048 || l.tokens != 2048 {
+		t.Errorf("newRateLimiter(2) = %+v, want a full bucket of 2048 B/s", l)
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	const slack = 100 * time.Millisecond
+	tests := []struct {
+		name  string
+		sizes []int // reserved in turn from a full 1 KiB/s bucket
+		want  time.Duration
+	}{
+		{"within the bucket", []int{512}, 0},
+		{"exactly the bucket", []int{1024}, 0},
+		{"half a second over", []int{1536}, 500 * time.Millisecond},
+		{"debt adds up", []int{1024, 1024}, time.Second},
+		{"two seconds over", []int{512, 2560}, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(1)
+			var wait time.Duration
+			for _, n := range tt.sizes {
+				wait = l.reserve(n)
+			}
+			if wait < tt.want-slack || wait > tt.want {
+				t.Errorf("wait = %v, want about %v", wait, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterChunk(t *testing.T) {
+	tests := []struct {
+		kib  int
+		want int
+	}{
+		{1, 1024}, // never below 1 KiB
+		{4, 1024},
+		{64, 16384},
+	}
+	for _, tt := range tests {
+		if got := newRateLimiter(tt.kib).chunk(); got != tt.want {
+			t.Errorf("chunk() at %d KiB/s = %d, want %d", tt.kib, got, tt.want)
+		}
+	}
+}
+
+// recordingWriter keeps the size of every write.
+type recordingWriter struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.sizes = append(w.sizes, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestThrottle(t *testing.T) {
+	var w recordingWriter
+	if got := throttle(&w, nil, nil); got != &w {
+		t.Fatal("throttle without limiters should return the writer itself")
+	}
+
+	// Fast enough not to sleep, but split into the smaller limiter's chunks
+	tw := throttle(&w, newRateLimiter(1<<20), newRateLimiter(64))
+	data := bytes.Repeat([]byte("x"), 40000)
+	n, err := tw.Write(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("Write() = %d, %v, want %d, nil", n, err, len(data))
+	}
+	if !bytes.Equal(w.Bytes(), data) {
+		t.Fatal("written data differs")
+	}
+	if want := []int{16384, 16384, 7232}; !slices.Equal(w.sizes, want) {
+		t.Fatalf("write sizes = %v, want %v", w.sizes, want)
+	}
+}
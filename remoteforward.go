@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const remoteListenTimeout = 15 * time.Second
+
+// remoteBindAddr reads a remote forward's RemoteAddr as the server should
+// bind it. An empty host or * means every interface and localhost means
+// loopback, as with ssh -R. The server reports connections by address, so
+// other host names are resolved here. Port 0 lets the server pick.
+func remoteBindAddr(addr string) (*net.TCPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	switch host {
+	case "", "*":
+		host = "0.0.0.0"
+	case "localhost":
+		host = "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+	return net.ResolveTCPAddr("tcp", net.JoinHostPort(host, portStr))
+}
+
+// listenRemote asks the server to listen on addr and waits for its
+// answer. The listener's Addr has the port the server picked.
+func listenRemote(client *ssh.Client, addr string) (net.Listener, error) {
+	laddr, err := remoteBindAddr(addr)
+	if err != nil {
+		return nil, fmt.Errorf("remote forward %s: %w", addr, err)
+	}
+	type result struct {
+		ln  net.Listener
+		err error
+	}
+	done := make(chan result, 1)
+	safeGo(func() {
+		ln, err := client.ListenTCP(laddr)
+		done <- result{ln, err}
+	})
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, remoteListenError(addr, laddr, r.err)
+		}
+		return r.ln, nil
+	case <-time.After(remoteListenTimeout):
+		// Don't leave the forward behind if the answer comes later
+		safeGo(func() {
+			if r := <-done; r.ln != nil {
+				r.ln.Close()
+			}
+		})
+		return nil, fmt.Errorf("remote listen on %s: no answer from the server after %s", addr, remoteListenTimeout)
+	}
+}
+
+// remoteListenError explains a refused tcpip-forward request. The
+// protocol carries no reason, so this lists the usual ones.
+func remoteListenError(addr string, laddr *net.TCPAddr, err error) error {
+	if !strings.Contains(err.Error(), "denied by peer") {
+		return fmt.Errorf("remote listen on %s failed: %w", addr, err)
+	}
+	if !laddr.IP.IsLoopback() {
+		return fmt.Errorf("server refused to listen on %s: binding a non-loopback address needs GatewayPorts clientspecified in its sshd_config; the port may also be in use or remote forwarding disabled", addr)
+	}
+	return fmt.Errorf("server refused to listen on %s: the port may be in use or privileged, or remote forwarding is disabled (AllowTcpForwarding)", addr)
+}
+
+// listenAddr is where a forward accepts connections: on the server for
+// remote forwards, on this machine otherwise.
+func (f ForwardConfig) listenAddr() string {
+	if f.Type == ForwardRemote {
+		return f.RemoteAddr
+	}
+	return f.LocalAddr
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Route targets besides tunnel IDs
+const (
+	routeDirect = "direct"
+	routeReject = "reject"
+)
+
+const routerDialTimeout = 10 * time.Second
+
+// RouterConfig configures the router listener, which accepts SOCKS5 and
+// HTTP proxy clients on one port and sends each destination through the
+// tunnel picked by the first matching rule.
+type RouterConfig struct {
+	ListenAddr string      `json:"listen_addr,omitempty"`
+	Rules      []RouteRule `json:"rules,omitempty"`
+	Unmatched  string      `json:"unmatched,omitempty"` // "direct" (default) or "reject"
+	Allow      []string    `json:"allow,omitempty"`     // client CIDRs, as for forwards
+	Deny       []string    `json:"deny,omitempty"`
+}
+
+// RouteRule sends destinations matching Match through Tunnel. Match is a
+// domain, which also covers its subdomains, a glob such as "*.corp.*", or
+// a CIDR for IP literal destinations. Tunnel is a tunnel ID, "direct" or
+// "reject".
+type RouteRule struct {
+	Match  string `json:"match"`
+	Tunnel string `json:"tunnel"`
+}
+
+type compiledRoute struct {
+	domain string
+	glob   bool
+	prefix netip.Prefix
+	target string
+}
+
+func compileRoutes(rules []RouteRule) ([]compiledRoute, error) {
+	routes := make([]compiledRoute, 0, len(rules))
+	for i, r := range rules {
+		if r.Tunnel == "" {
+			return nil, fmt.Errorf("route %d: no tunnel", i+1)
+		}
+		c := compiledRoute{target: r.Tunnel}
+		if p, err := parsePrefixes([]string{r.Match}); err == nil && len(p) == 1 {
+			c.prefix = p[0]
+		} else {
+			c.domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(r.Match), "."))
+			if c.domain == "" {
+				return nil, fmt.Errorf("route %d: empty match", i+1)
+			}
+			c.glob = strings.ContainsAny(c.domain, "*?[")
+			if _, err := path.Match(c.domain, ""); err != nil {
+				return nil, fmt.Errorf("route %d: invalid pattern %q", i+1, r.Match)
+			}
+		}
+		routes = append(routes, c)
+	}
+	return routes, nil
+}
+
+func (c compiledRoute) matches(host string, ip netip.Addr) bool {
+	switch {
+	case c.prefix.IsValid():
+		return ip.IsValid() && c.prefix.Contains(ip)
+	case c.glob:
+		ok, _ := path.Match(c.domain, host)
+		return ok
+	default:
+		return host == c.domain || strings.HasSuffix(host, "."+c.domain)
+	}
+}
+
+// routeDecision is where a destination goes and which rule said so; rule
+// is -1 when none matched.
+type routeDecision struct {
+	target string
+	rule   int
+}
+
+func routeHost(routes []compiledRoute, unmatched, host string) routeDecision {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip, _ := netip.ParseAddr(host)
+	ip = ip.Unmap()
+	for i, r := range routes {
+		if r.matches(host, ip) {
+			return routeDecision{target: r.target, rule: i}
+		}
+	}
+	if unmatched == routeReject {
+		return routeDecision{target: routeReject, rule: -1}
+	}
+	return routeDecision{target: routeDirect, rule: -1}
+}
+
+// router is the running router listener.
+type router struct {
+	state     *AppState
+	ln        net.Listener
+	routes    []compiledRoute
+	unmatched string
+	acl       *sourceACL // nil when every client is accepted
+	stats     *ForwardStats
+	log       *slog.Logger
+}
+
+// restartRouter closes the current router listener, if any, and starts a
+// new one when cfg has a listen address. It fails if the rules or client
+// lists don't parse or the address can't be listened on.
+func (state *AppState) restartRouter(cfg RouterConfig) error {
+	if state.router != nil {
+		state.router.ln.Close()
+		state.router = nil
+	}
+	if cfg.ListenAddr == "" {
+		return nil
+	}
+	routes, err := compileRoutes(cfg.Rules)
+	if err != nil {
+		slog.Error("Router disabled, invalid rules", "err", err)
+		return fmt.Errorf("router rules: %w", err)
+	}
+	acl, err := newSourceACL(ForwardConfig{Allow: cfg.Allow, Deny: cfg.Deny})
+	if err != nil {
+		slog.Error("Router disabled, invalid client list", "err", err)
+		return fmt.Errorf("router clients: %w", err)
+	}
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		slog.Error("Router listener failed", "addr", cfg.ListenAddr, "err", err)
+		return fmt.Errorf("router listener on %s: %w", cfg.ListenAddr, err)
+	}
+	r := &router{
+		state:     state,
+		ln:        ln,
+		routes:    routes,
+		unmatched: cfg.Unmatched,
+		acl:       acl,
+		stats:     newForwardStats(),
+		log:       slog.With("router", cfg.ListenAddr),
+	}
+	state.router = r
+	r.log.Info("Router listening", "rules", len(routes))
+	if warning := routerExposureWarning(cfg); warning != "" {
+		r.log.Warn(warning)
+	}
+	safeGo(r.acceptLoop)
+	return nil
+}
+
+func (r *router) acceptLoop() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			r.log.Warn("Accept error", "err", err)
+			continue
+		}
+		safeGo(func() { r.handle(conn) })
+	}
+}
+
+// bufferedConn reads through the reader used to sniff the protocol, so
+// nothing it buffered is lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// routedConn is one router connection, audited like a forward's.
+type routedConn struct {
+	rec AuditRecord
+	tc  *TrackedConn
+}
+
+func (r *router) handle(conn net.Conn) {
+	defer conn.Close()
+	rc := &routedConn{rec: AuditRecord{
+		Time:        time.Now(),
+		ForwardType: "router",
+		Forward:     "Router " + r.ln.Addr().String(),
+		Client:      conn.RemoteAddr().String(),
+		CloseReason: "handshake failed",
+	}}
+	defer r.finish(rc)
+	if ok, why := r.acl.permits(conn.RemoteAddr()); !ok {
+		r.log.Warn("Connection rejected", "remote", conn.RemoteAddr().String(), "reason", why)
+		rc.rec.CloseReason = why
+		return
+	}
+
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	bc := &bufferedConn{Conn: conn, r: br}
+	lg := r.log.With("remote", conn.RemoteAddr().String())
+	if first[0] == 5 {
+		r.handleSOCKS(bc, rc, lg)
+	} else {
+		r.handleHTTP(bc, rc, lg)
+	}
+}
+
+func (r *router) finish(rc *routedConn) {
+	rc.rec.DurationMs = time.Since(rc.rec.Time).Milliseconds()
+	if rc.tc != nil {
+		rc.rec.BytesIn = rc.tc.BytesIn.Load()
+		rc.rec.BytesOut = rc.tc.BytesOut.Load()
+	}
+	audit.write(rc.rec)
+}
+
+var (
+	errRouteRejected = errors.New("rejected by router rules")
+	errDestBlocked   = errors.New("blocked by destination rules")
+)
+
+// refused reports whether err means the rules turned the request down,
+// rather than the connection failing.
+func refused(err error) bool {
+	return errors.Is(err, errRouteRejected) || errors.Is(err, errDestBlocked)
+}
+
+// dial connects to host:port the way the rules say. For tunnel routes the
+// tunnel is returned too, so its limits apply and it counts the
+// connection as in use, and the tunnel's destination rules are obeyed.
+func (r *router) dial(rc *routedConn, host string, port int) (net.Conn, *RunningTunnel, error) {
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	rc.rec.Target = target
+	d := routeHost(r.routes, r.unmatched, host)
+	switch d.target {
+	case routeReject:
+		return nil, nil, errRouteRejected
+	case routeDirect:
+		conn, err := net.DialTimeout("tcp", target, routerDialTimeout)
+		return conn, nil, err
+	}
+	rt, ok := r.state.getRunning(d.target)
+	if !ok {
+		return nil, nil, fmt.Errorf("tunnel %s is not running", d.target)
+	}
+	rc.rec.TunnelID = rt.Cfg.ID
+	rc.rec.Tunnel = rt.Cfg.Name
+	if !tunnelPermits(rt.Cfg, host, port) {
+		r.stats.Blocked.Add(1)
+		return nil, nil, fmt.Errorf("tunnel %s: %w", rt.Cfg.Name, errDestBlocked)
+	}
+	// Counted from here so an on-demand tunnel doesn't go idle while the
+	// connection is being set up; relay counts it from then on
+	rt.routed.Add(1)
+	defer rt.routed.Add(-1)
+	client, err := rt.acquireClient()
+	if err != nil {
+		return nil, nil, fmt.Errorf("tunnel %s: %w", rt.Cfg.Name, err)
+	}
+	dialStart := time.Now()
+	conn, err := dialThrough(client, target, routerDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	metrics.observeDial(rt.Cfg, time.Since(dialStart))
+	return conn, rt, nil
+}
+
+// relay pipes an established connection, counting it against the tunnel
+// it goes through.
+func (r *router) relay(client *bufferedConn, remote net.Conn, rt *RunningTunnel, rc *routedConn) {
+	defer remote.Close()
+	rc.tc = r.stats.open(rc.rec.Client, rc.rec.Target)
+	defer r.stats.close(rc.tc)
+	var limits connLimits
+	if rt != nil {
+		rt.routed.Add(1)
+		defer rt.routed.Add(-1)
+		rt.touch()
+		limits.upload = []*rateLimiter{rt.upload}
+		limits.download = []*rateLimiter{rt.download}
+	}
+	rc.rec.CloseReason = pipe(client, remote, r.stats, rc.tc, limits)
+}
+
+func (r *router) handleSOCKS(conn *bufferedConn, rc *routedConn, lg *slog.Logger) {
+	host, port, err := readSOCKSRequest(conn)
+	if err != nil {
+		lg.Warn("SOCKS handshake failed", "err", err)
+		return
+	}
+	remote, rt, err := r.dial(rc, host, port)
+	if err != nil {
+		lg.Warn("Router dial failed", "target", rc.rec.Target, "err", err)
+		rc.rec.CloseReason = "dial failed: " + err.Error()
+		if refused(err) {
+			socksReply(conn, socksNotAllowed)
+		} else {
+			socksReply(conn, socksGeneralFailure)
+		}
+		return
+	}
+	socksReply(conn, socksSucceeded)
+	r.relay(conn, remote, rt, rc)
+}
+
+func (r *router) handleHTTP(conn *bufferedConn, rc *routedConn, lg *slog.Logger) {
+	req, err := http.ReadRequest(conn.r)
+	if err != nil {
+		lg.Warn("HTTP proxy request failed", "err", err)
+		return
+	}
+	target := req.Host
+	defaultPort := "443"
+	if req.Method != http.MethodConnect {
+		if req.URL.Host == "" {
+			httpError(conn, http.StatusBadRequest)
+			rc.rec.CloseReason = "not a proxy request"
+			return
+		}
+		target = req.URL.Host
+		defaultPort = "80"
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		host, portStr = strings.Trim(target, "[]"), defaultPort
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		httpError(conn, http.StatusBadRequest)
+		return
+	}
+
+	remote, rt, err := r.dial(rc, host, port)
+	if err != nil {
+		lg.Warn("Router dial failed", "target", rc.rec.Target, "err", err)
+		rc.rec.CloseReason = "dial failed: " + err.Error()
+		if refused(err) {
+			httpError(conn, http.StatusForbidden)
+		} else {
+			httpError(conn, http.StatusBadGateway)
+		}
+		return
+	}
+	if req.Method == http.MethodConnect {
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	} else {
+		// Plain HTTP: one request per connection, as the next one may be
+		// for another host
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+		req.Close = true
+		if err := req.Write(remote); err != nil {
+			remote.Close()
+			httpError(conn, http.StatusBadGateway)
+			rc.rec.CloseReason = "remote error: " + err.Error()
+			return
+		}
+	}
+	r.relay(conn, remote, rt, rc)
+}
+
+func httpError(conn net.Conn, code int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+}
+
+// formatRouteRules renders rules one per line as "match tunnel-name" for
+// the router dialog.
+func formatRouteRules(rules []RouteRule, cfgs []TunnelConfig) string {
+	lines := make([]string, len(rules))
+	for i, r := range rules {
+		lines[i] = r.Match + " " + routeTargetName(r.Tunnel, cfgs)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseRouteRules reads the dialog format back, resolving tunnel names to
+// IDs. "direct" and "reject" are keywords rather than tunnel names.
+func parseRouteRules(s string, cfgs []TunnelConfig) ([]RouteRule, error) {
+	var rules []RouteRule
+	for n, line := range strings.Split(s, "\n") {
+		match, name, _ := strings.Cut(strings.TrimSpace(line), " ")
+		name = strings.TrimSpace(name)
+		if match == "" {
+			continue
+		}
+		if name == "" {
+			return nil, fmt.Errorf("route line %d: no tunnel given", n+1)
+		}
+		rule := RouteRule{Match: match}
+		switch strings.ToLower(name) {
+		case routeDirect, routeReject:
+			rule.Tunnel = strings.ToLower(name)
+		default:
+			for _, cfg := range cfgs {
+				if cfg.Name == name || cfg.ID == name {
+					if rule.Tunnel != "" {
+						return nil, fmt.Errorf("route line %d: more than one tunnel is named %q", n+1, name)
+					}
+					rule.Tunnel = cfg.ID
+				}
+			}
+			if rule.Tunnel == "" {
+				return nil, fmt.Errorf("route line %d: no tunnel named %q", n+1, name)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if _, err := compileRoutes(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func routeTargetName(target string, cfgs []TunnelConfig) string {
+	for _, cfg := range cfgs {
+		if cfg.ID == target {
+			return cfg.Name
+		}
+	}
+	return target
+}
+
+// describeRoute explains where host would go, for the rule tester.
+func (state *AppState) describeRoute(rules []RouteRule, unmatched, host string) string {
+	routes, err := compileRoutes(rules)
+	if err != nil {
+		return err.Error()
+	}
+	d := routeHost(routes, unmatched, host)
+	why := "no rule matched"
+	if d.rule >= 0 {
+		why = fmt.Sprintf("rule %d: %s", d.rule+1, rules[d.rule].Match)
+	}
+	switch d.target {
+	case routeDirect:
+		return fmt.Sprintf("Direct connection (%s)", why)
+	case routeReject:
+		return fmt.Sprintf("Rejected (%s)", why)
+	}
+	status := StatusStopped
+	if rt, ok := state.getRunning(d.target); ok {
+		status = rt.Status()
+	}
+	return fmt.Sprintf("Tunnel %s, currently %s (%s)", routeTargetName(d.target, state.configs), status, why)
+}
+
+func (state *AppState) routerDialog(w fyne.Window) {
+	cfg := state.settings.Router
+	listenEntry := widget.NewEntry()
+	listenEntry.SetPlaceHolder("127.0.0.1:1081 (empty to disable)")
+	listenEntry.SetText(cfg.ListenAddr)
+	unmatchedSelect := widget.NewSelect([]string{"Connect directly", "Reject"}, nil)
+	if cfg.Unmatched == routeReject {
+		unmatchedSelect.SetSelected("Reject")
+	} else {
+		unmatchedSelect.SetSelected("Connect directly")
+	}
+	unmatched := func() string {
+		if unmatchedSelect.Selected == "Reject" {
+			return routeReject
+		}
+		return routeDirect
+	}
+	rulesEntry := widget.NewMultiLineEntry()
+	rulesEntry.SetPlaceHolder("corp.example.com Office\n10.20.0.0/16 Staging\n*.internal reject")
+	rulesEntry.SetText(formatRouteRules(cfg.Rules, state.configs))
+	rulesEntry.SetMinRowsVisible(6)
+	allowEntry := widget.NewEntry()
+	allowEntry.SetPlaceHolder("10.0.0.0/8, 192.168.1.20")
+	allowEntry.SetText(strings.Join(cfg.Allow, ", "))
+	denyEntry := widget.NewEntry()
+	denyEntry.SetPlaceHolder("10.0.5.0/24")
+	denyEntry.SetText(strings.Join(cfg.Deny, ", "))
+
+	testEntry := widget.NewEntry()
+	testEntry.SetPlaceHolder("host or IP to test")
+	testResult := widget.NewLabel("")
+	testResult.Wrapping = fyne.TextWrapWord
+	testButton := widget.NewButton("Test", func() {
+		rules, err := parseRouteRules(rulesEntry.Text, state.configs)
+		if err != nil {
+			testResult.SetText(err.Error())
+			return
+		}
+		testResult.SetText(state.describeRoute(rules, unmatched(), strings.TrimSpace(testEntry.Text)))
+	})
+
+	form := widget.NewForm(
+		&widget.FormItem{Text: "Listen Address:", Widget: listenEntry, HintText: "Accepts SOCKS5 and HTTP proxy clients"},
+		&widget.FormItem{Text: "Rules:", Widget: rulesEntry, HintText: "One \"domain-or-CIDR tunnel-name\" per line; first match wins. Use direct or reject as the tunnel to bypass or block."},
+		&widget.FormItem{Text: "Unmatched Traffic:", Widget: unmatchedSelect},
+		&widget.FormItem{Text: "Allow Clients From:", Widget: allowEntry, HintText: "Comma separated CIDRs; empty allows any client"},
+		&widget.FormItem{Text: "Deny Clients From:", Widget: denyEntry, HintText: "Comma separated CIDRs; checked before the allow list"},
+		&widget.FormItem{Text: "Test Host:", Widget: container.NewBorder(nil, nil, nil, testButton, testEntry)},
+		&widget.FormItem{Text: "", Widget: testResult},
+	)
+	d := dialog.NewCustomConfirm("Router", "Save", "Cancel", container.NewPadded(form), func(confirm bool) {
+		if !confirm {
+			return
+		}
+		rules, err := parseRouteRules(rulesEntry.Text, state.configs)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		allow, deny := splitList(allowEntry.Text), splitList(denyEntry.Text)
+		if _, err := newSourceACL(ForwardConfig{Allow: allow, Deny: deny}); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		state.settings.Router = RouterConfig{
+			ListenAddr: strings.TrimSpace(listenEntry.Text),
+			Rules:      rules,
+			Unmatched:  unmatched(),
+			Allow:      allow,
+			Deny:       deny,
+		}
+		if err := saveSettings(state.settings, state.settingsFile); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		slog.Info("Router settings saved", "path", state.settingsFile)
+		if err := state.restartRouter(state.settings.Router); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		if warning := routerExposureWarning(state.settings.Router); warning != "" {
+			dialog.ShowInformation("Listener Open to the Network",
+				warning+"\n\nSet an allow or deny list to restrict which clients may connect.", w)
+		}
+	}, w)
+	d.Resize(fyne.NewSize(500, 450))
+	d.Show()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRouteHost(t *testing.T) {
+	routes, err := compileRoutes([]RouteRule{
+		{Match: "corp.example.com", Tunnel: "work"},
+		{Match: "*.lab.*", Tunnel: "lab"},
+		{Match: "10.0.0.0/8", Tunnel: "work"},
+		{Match: "2001:db8::/32", Tunnel: "lab"},
+		{Match: "ads.example.net.", Tunnel: routeReject},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host      string
+		unmatched string
+		want      routeDecision
+	}{
+		{"corp.example.com", "", routeDecision{"work", 0}},
+		{"git.corp.example.com", "", routeDecision{"work", 0}},
+		{"GIT.Corp.Example.com.", "", routeDecision{"work", 0}},
+		{"notcorp.example.com", "", routeDecision{routeDirect, -1}},
+		{"build.lab.local", "", routeDecision{"lab", 1}},
+		{"10.1.2.3", "", routeDecision{"work", 2}},
+		{"::ffff:10.1.2.3", "", routeDecision{"work", 2}},
+		{"2001:db8::1", "", routeDecision{"lab", 3}},
+		{"ads.example.net", "", routeDecision{routeReject, 4}},
+		{"192.168.1.1", routeReject, routeDecision{routeReject, -1}},
+		{"example.org", routeDirect, routeDecision{routeDirect, -1}},
+	}
+	for _, tt := range tests {
+		if got := routeHost(routes, tt.unmatched, tt.host); got != tt.want {
+			t.Errorf("routeHost(%q, %q) = %+v, want %+v", tt.host, tt.unmatched, got, tt.want)
+		}
+	}
+}
+
+func TestCompileRoutesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule RouteRule
+	}{
+		{"no tunnel", RouteRule{Match: "example.com"}},
+		{"empty match", RouteRule{Match: " ", Tunnel: "work"}},
+		{"bad pattern", RouteRule{Match: "[a-", Tunnel: "work"}},
+	}
+	for _, tt := range tests {
+		if _, err := compileRoutes([]RouteRule{tt.rule}); err == nil {
+			t.Errorf("%s: compileRoutes() succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestParseRouteRules(t *testing.T) {
+	work, lab, dup := testTunnel("w1"), testTunnel("l1"), testTunnel("d1")
+	work.Name, lab.Name, dup.Name = "Work", "Lab", "Lab"
+	cfgs := []TunnelConfig{work, lab}
+
+	tests := []struct {
+		in      string
+		cfgs    []TunnelConfig
+		want    []RouteRule
+		wantErr bool
+	}{
+		{"", cfgs, nil, false},
+		{"corp.example.com Work\n\n10.0.0.0/8 l1", cfgs, []RouteRule{
+			{Match: "corp.example.com", Tunnel: "w1"},
+			{Match: "10.0.0.0/8", Tunnel: "l1"},
+		}, false},
+		{"ads.example.net REJECT\n* direct", cfgs, []RouteRule{
+			{Match: "ads.example.net", Tunnel: routeReject},
+			{Match: "*", Tunnel: routeDirect},
+		}, false},
+		{"example.com", cfgs, nil, true},
+		{"example.com Home", cfgs, nil, true},
+		{"example.com Lab", append(cfgs, dup), nil, true},
+		{"[a- Work", cfgs, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRouteRules(tt.in, tt.cfgs)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRouteRules(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseRouteRules(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	rules := []RouteRule{{Match: "corp.example.com", Tunnel: "w1"}, {Match: "*.lab.*", Tunnel: routeDirect}}
+	got, err := parseRouteRules(formatRouteRules(rules, cfgs), cfgs)
+	if err != nil || !slices.Equal(got, rules) {
+		t.Errorf("round trip = %+v, %v, want %+v", got, err, rules)
+	}
+}
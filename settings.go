@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// AppSettings holds application-wide options. They live in settings.json
+// next to tunnels.json so the tunnel file stays a plain list.
+type AppSettings struct {
+	MetricsAddr string `json:"metrics_addr,omitempty"`
+	LogLevel    string `json:"log_level,omitempty"`
+
+	LaunchAtLogin bool `json:"launch_at_login,omitempty"`
+
+	Router RouterConfig `json:"router"`
+
+	// Shell file listing the ports tunnels are bound to, for scripts
+	PortsEnvFile string `json:"ports_env_file,omitempty"`
+
+	// Remembered answers to login prompts, by server and prompt
+	PromptAnswers map[string]map[string]string `json:"prompt_answers,omitempty"`
+}
+
+func settingsPath(configFile string) string {
+	return filepath.Join(filepath.Dir(configFile), "settings.json")
+}
+
+func loadSettings(file string) (AppSettings, error) {
+	var s AppSettings
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+// saveSettings writes s to file readable by the owner only, since it can
+// hold remembered login answers. Files saved by older versions are
+// tightened too.
+func saveSettings(s AppSettings, file string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(file, 0600)
+}
+
+// applySettings (re)starts the optional services that depend on settings.
+// It returns why the metrics server or router could not start, if they
+// couldn't.
+func (state *AppState) applySettings() error {
+	setLogLevel(state.settings.LogLevel)
+	metricsErr := state.restartMetricsServer(state.settings.MetricsAddr)
+	routerErr := state.restartRouter(state.settings.Router)
+	state.writePortsEnv()
+	return errors.Join(metricsErr, routerErr)
+}
+
+func (state *AppState) settingsDialog(w fyne.Window) {
+	metricsEntry := widget.NewEntry()
+	metricsEntry.SetPlaceHolder("127.0.0.1:9273 (empty to disable)")
+	metricsEntry.SetText(state.settings.MetricsAddr)
+	levelSelect := widget.NewSelect(logLevelNames, nil)
+	levelSelect.SetSelected(parseLogLevel(state.settings.LogLevel).String())
+	loginCheck := widget.NewCheck("Launch at login", nil)
+	loginCheck.SetChecked(state.settings.LaunchAtLogin)
+	envFileEntry := widget.NewEntry()
+	envFileEntry.SetPlaceHolder("~/.sshtunnel-ports.env (empty to disable)")
+	envFileEntry.SetText(state.settings.PortsEnvFile)
+	forgetCheck := widget.NewCheck(fmt.Sprintf("Forget remembered login answers (%d servers)", len(state.settings.PromptAnswers)), nil)
+	if len(state.settings.PromptAnswers) == 0 {
+		forgetCheck.Disable()
+	}
+
+	form := widget.NewForm(
+		&widget.FormItem{Text: "Metrics Address:", Widget: metricsEntry, HintText: "Serves Prometheus metrics on /metrics"},
+		&widget.FormItem{Text: "Log Level:", Widget: levelSelect},
+		&widget.FormItem{Text: "", Widget: loginCheck},
+		&widget.FormItem{Text: "Ports Env File:", Widget: envFileEntry, HintText: "Lists each running forward's address and port for scripts to source"},
+		&widget.FormItem{Text: "", Widget: forgetCheck},
+	)
+	d := dialog.NewCustomConfirm("Settings", "Save", "Cancel", container.NewPadded(form), func(confirm bool) {
+		if !confirm {
+			return
+		}
+		state.settings.MetricsAddr = metricsEntry.Text
+		state.settings.LogLevel = levelSelect.Selected
+		if loginCheck.Checked != state.settings.LaunchAtLogin {
+			// Only touch the autostart entry when the choice changes
+			if err := setLaunchAtLogin(loginCheck.Checked); err != nil {
+				slog.Warn("Failed to update launch at login", "enabled", loginCheck.Checked, "err", err)
+				dialog.ShowError(fmt.Errorf("launch at login: %w", err), w)
+			} else {
+				state.settings.LaunchAtLogin = loginCheck.Checked
+			}
+		}
+		state.settings.PortsEnvFile = envFileEntry.Text
+		if forgetCheck.Checked {
+			state.settings.PromptAnswers = nil
+		}
+		if err := saveSettings(state.settings, state.settingsFile); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		slog.Info("Settings saved", "path", state.settingsFile)
+		if err := state.applySettings(); err != nil {
+			dialog.ShowError(err, w)
+		}
+	}, w)
+	d.Resize(fyne.NewSize(450, 300))
+	d.Show()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// SOCKS5 reply codes
+const (
+	socksSucceeded      = 0
+	socksGeneralFailure = 1
+	socksNotAllowed     = 2
+	socksUnsupportedCmd = 7
+	socksUnsupportedAdr = 8
+)
+
+// readSOCKSRequest performs the SOCKS5 greeting without authentication and
+// reads a CONNECT request, returning the requested destination. Requests
+// it can't serve are answered with the matching failure reply.
+func readSOCKSRequest(rw io.ReadWriter) (host string, port int, err error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(rw, hdr); err != nil {
+		return "", 0, err
+	}
+	if hdr[0] != 5 {
+		return "", 0, fmt.Errorf("invalid SOCKS version %d", hdr[0])
+	}
+	if _, err := io.ReadFull(rw, make([]byte, hdr[1])); err != nil {
+		return "", 0, err
+	}
+	if _, err := rw.Write([]byte{5, 0}); err != nil {
+		return "", 0, err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(rw, req); err != nil {
+		return "", 0, err
+	}
+	if req[0] != 5 {
+		return "", 0, fmt.Errorf("invalid SOCKS version %d", req[0])
+	}
+	if req[1] != 1 {
+		socksReply(rw, socksUnsupportedCmd)
+		return "", 0, fmt.Errorf("unsupported SOCKS command %d", req[1])
+	}
+	switch req[3] {
+	case 1: // IPv4
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(rw, addr); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(addr).String()
+	case 3: // Domain name
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(rw, n); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(rw, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	case 4: // IPv6
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(rw, addr); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(addr).String()
+	default:
+		socksReply(rw, socksUnsupportedAdr)
+		return "", 0, fmt.Errorf("unsupported SOCKS address type %d", req[3])
+	}
+	p := make([]byte, 2)
+	if _, err := io.ReadFull(rw, p); err != nil {
+		return "", 0, err
+	}
+	port = int(binary.BigEndian.Uint16(p))
+	if host == "" || port == 0 {
+		socksReply(rw, socksGeneralFailure)
+		return "", 0, errors.New("empty SOCKS destination")
+	}
+	return host, port, nil
+}
+
+// socksReply answers a CONNECT request. The bound address is always
+// reported as 0.0.0.0:0, which clients ignore.
+func socksReply(w io.Writer, code byte) {
+	_, _ = w.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+}
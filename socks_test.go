@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// socksConn feeds a client's bytes to readSOCKSRequest and keeps its replies.
+type socksConn struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func (c *socksConn) Read(p []byte) (int, error) { return c.Reader.Read(p) }
+
+func TestReadSOCKSRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  []byte
+		wantHost string
+		wantPort int
+		wantErr  bool
+		reply    []byte // written after the method selection, if any
+	}{
+		{"ipv4", []byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80}, "10.0.0.1", 80, false, nil},
+		{"domain", append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 1, 187), "example.com", 443, false, nil},
+		{"ipv6", []byte{5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 22}, "2001:db8::1", 22, false, nil},
+		{"bind command", []byte{5, 2, 0, 1, 10, 0, 0, 1, 0, 80}, "", 0, true, []byte{5, socksUnsupportedCmd, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"unknown address type", []byte{5, 1, 0, 9}, "", 0, true, []byte{5, socksUnsupportedAdr, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"zero port", []byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 0}, "", 0, true, []byte{5, socksGeneralFailure, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"empty domain", []byte{5, 1, 0, 3, 0, 0, 80}, "", 0, true, []byte{5, socksGeneralFailure, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"wrong request version", []byte{4, 1, 0, 1, 10, 0, 0, 1, 0, 80}, "", 0, true, nil},
+		{"truncated", []byte{5, 1, 0, 3, 11, 'e', 'x'}, "", 0, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &socksConn{Reader: bytes.NewReader(append([]byte{5, 1, 0}, tt.request...))}
+			host, port, err := readSOCKSRequest(conn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readSOCKSRequest() error = %v, want error %v", err, tt.wantErr)
+			}
+			if host != tt.wantHost || port != tt.wantPort {
+				t.Errorf("readSOCKSRequest() = %q, %d, want %q, %d", host, port, tt.wantHost, tt.wantPort)
+			}
+			if want := append([]byte{5, 0}, tt.reply...); !bytes.Equal(conn.Bytes(), want) {
+				t.Errorf("replies = %v, want %v", conn.Bytes(), want)
+			}
+		})
+	}
+
+	conn := &socksConn{Reader: bytes.NewReader([]byte{4, 1, 0})}
+	if _, _, err := readSOCKSRequest(conn); err == nil || conn.Len() != 0 {
+		t.Errorf("SOCKS4 greeting: err = %v, replies = %v, want an error and no reply", err, conn.Bytes())
+	}
+}
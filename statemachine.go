@@ -0,0 +1,271 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"golang.org/x/crypto/ssh"
+)
+
+// TunnelEvent is published whenever a running tunnel changes status.
+type TunnelEvent struct {
+	TunnelID string
+	Name     string
+	From     TunnelStatus
+	To       TunnelStatus
+	ErrorMsg string
+	Time     time.Time
+}
+
+// tunnelTransitions lists the statuses each status may move to. Anything
+// not listed here is rejected by RunningTunnel.transition.
+var tunnelTransitions = map[TunnelStatus][]TunnelStatus{
+	StatusStopped:      {StatusConnecting},
+	StatusConnecting:   {StatusConnected, StatusIdle, StatusError, StatusStopped},
+	StatusConnected:    {StatusIdle, StatusError, StatusDisconnected, StatusStopped},
+	StatusError:        {StatusConnecting, StatusStopped},
+	StatusDisconnected: {StatusConnecting, StatusStopped},
+	StatusIdle:         {StatusConnecting, StatusError, StatusStopped},
+}
+
+// isUp reports whether a tunnel in this status is serving its forwards,
+// either connected or listening to connect on demand.
+func (s TunnelStatus) isUp() bool {
+	return s == StatusConnected || s == StatusIdle
+}
+
+func canTransition(from, to TunnelStatus) bool {
+	for _, s := range tunnelTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// eventBus fans tunnel events out to subscribers. Each subscriber gets its
+// own buffered channel so a slow consumer can't block tunnel goroutines.
+type eventBus struct {
+	mu     sync.Mutex
+	subs   map[int]chan TunnelEvent
+	nextID int
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[int]chan TunnelEvent)}
+}
+
+// subscribe returns a channel of future events and a function that
+// unsubscribes and closes the channel.
+func (b *eventBus) subscribe() (<-chan TunnelEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	ch := make(chan TunnelEvent, 256)
+	b.subs[id] = ch
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[id]; ok {
+			delete(b.subs, id)
+			close(ch)
+		}
+	}
+}
+
+func (b *eventBus) publish(ev TunnelEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			slog.Warn("Dropping event: subscriber not keeping up", "tunnel", ev.TunnelID)
+		}
+	}
+}
+
+func newRunningTunnel(cfg TunnelConfig, events *eventBus) *RunningTunnel {
+	return &RunningTunnel{
+		Cfg:    cfg,
+		status: StatusStopped,
+		events: events,
+		stats:  metrics.forwardStats(cfg),
+		log:    slog.With("tunnel", cfg.ID, "name", cfg.Name),
+
+		upload:   newRateLimiter(cfg.UploadLimit),
+		download: newRateLimiter(cfg.DownloadLimit),
+	}
+}
+
+// transition moves the tunnel to a new status and publishes an event.
+// Moving to the current status only updates the error message.
+func (rt *RunningTunnel) transition(to TunnelStatus, errMsg string) bool {
+	rt.mu.Lock()
+	from := rt.status
+	return rt.transitionLocked(from, to, errMsg)
+}
+
+// transitionFrom is like transition but only applies when the tunnel is
+// currently in the given status.
+func (rt *RunningTunnel) transitionFrom(from, to TunnelStatus, errMsg string) bool {
+	rt.mu.Lock()
+	if rt.status != from {
+		rt.mu.Unlock()
+		return false
+	}
+	return rt.transitionLocked(from, to, errMsg)
+}
+
+// transitionLocked expects rt.mu to be held and releases it.
+func (rt *RunningTunnel) transitionLocked(from, to TunnelStatus, errMsg string) bool {
+	if from == to {
+		// Only a changed error message is worth telling subscribers about
+		changed := rt.errorMsg != errMsg
+		rt.errorMsg = errMsg
+		rt.mu.Unlock()
+		if changed {
+			rt.publish(from, to, errMsg)
+		}
+		return true
+	}
+	if !canTransition(from, to) {
+		rt.mu.Unlock()
+		rt.log.Warn("Ignoring invalid transition", "from", from.String(), "to", to.String())
+		return false
+	}
+	rt.status = to
+	rt.errorMsg = errMsg
+	if to == StatusConnected {
+		rt.lastHeartbeat = time.Now()
+	}
+	rt.mu.Unlock()
+
+	rt.publish(from, to, errMsg)
+	return true
+}
+
+func (rt *RunningTunnel) publish(from, to TunnelStatus, errMsg string) {
+	rt.events.publish(TunnelEvent{
+		TunnelID: rt.Cfg.ID,
+		Name:     rt.Cfg.Name,
+		From:     from,
+		To:       to,
+		ErrorMsg: errMsg,
+		Time:     time.Now(),
+	})
+}
+
+func (rt *RunningTunnel) Status() TunnelStatus {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.status
+}
+
+func (rt *RunningTunnel) ErrorMsg() string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.errorMsg
+}
+
+func (rt *RunningTunnel) LastHeartbeat() time.Time {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.lastHeartbeat
+}
+
+func (rt *RunningTunnel) touch() {
+	rt.mu.Lock()
+	rt.lastHeartbeat = time.Now()
+	rt.mu.Unlock()
+}
+
+func (rt *RunningTunnel) sshClient() *ssh.Client {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.client
+}
+
+func (rt *RunningTunnel) setSSHClient(c *ssh.Client) {
+	rt.mu.Lock()
+	rt.client = c
+	rt.mu.Unlock()
+}
+
+// takeSSHClient clears and returns the client, so only one caller
+// releases it.
+func (rt *RunningTunnel) takeSSHClient() *ssh.Client {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	c := rt.client
+	rt.client = nil
+	return c
+}
+
+func (state *AppState) getRunning(id string) (*RunningTunnel, bool) {
+	state.runMu.Lock()
+	defer state.runMu.Unlock()
+	rt, ok := state.running[id]
+	return rt, ok
+}
+
+func (state *AppState) setRunning(id string, rt *RunningTunnel) {
+	state.runMu.Lock()
+	state.running[id] = rt
+	state.runMu.Unlock()
+}
+
+// removeRunning deletes the entry for id, but only if it still refers to
+// rt; a tunnel restarted in the meantime is left alone.
+func (state *AppState) removeRunning(id string, rt *RunningTunnel) {
+	state.runMu.Lock()
+	if state.running[id] == rt {
+		delete(state.running, id)
+	}
+	state.runMu.Unlock()
+}
+
+// runningTunnels returns a snapshot of the running tunnels by ID.
+func (state *AppState) runningTunnels() map[string]*RunningTunnel {
+	state.runMu.Lock()
+	defer state.runMu.Unlock()
+	out := make(map[string]*RunningTunnel, len(state.running))
+	for id, rt := range state.running {
+		out[id] = rt
+	}
+	return out
+}
+
+// subscribeUI refreshes the tunnel list and status bar on every event.
+func (state *AppState) subscribeUI() {
+	events, _ := state.events.subscribe()
+	safeGo(func() {
+		for range events {
+			fyne.Do(func() {
+				state.refreshList()
+				state.updateStatus()
+			})
+		}
+	})
+}
+
+// subscribeLog writes every status transition to the log.
+func (state *AppState) subscribeLog() {
+	events, _ := state.events.subscribe()
+	safeGo(func() {
+		for ev := range events {
+			attrs := []any{"tunnel", ev.TunnelID, "name", ev.Name, "from", ev.From.String(), "to", ev.To.String()}
+			if ev.ErrorMsg != "" {
+				slog.Warn("Tunnel status changed", append(attrs, "err", ev.ErrorMsg)...)
+			} else {
+				slog.Info("Tunnel status changed", attrs...)
+			}
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to TunnelStatus
+		want     bool
+	}{
+		{StatusStopped, StatusConnecting, true},
+		{StatusStopped, StatusConnected, false},
+		{StatusStopped, StatusError, false},
+		{StatusConnecting, StatusConnected, true},
+		{StatusConnecting, StatusIdle, true},
+		{StatusConnecting, StatusError, true},
+		{StatusConnecting, StatusStopped, true},
+		{StatusConnecting, StatusDisconnected, false},
+		{StatusConnected, StatusIdle, true},
+		{StatusConnected, StatusDisconnected, true},
+		{StatusConnected, StatusError, true},
+		{StatusConnected, StatusStopped, true},
+		{StatusConnected, StatusConnecting, false},
+		{StatusError, StatusConnecting, true},
+		{StatusError, StatusStopped, true},
+		{StatusError, StatusConnected, false},
+		{StatusDisconnected, StatusConnecting, true},
+		{StatusDisconnected, StatusConnected, false},
+		{StatusIdle, StatusConnecting, true},
+		{StatusIdle, StatusError, true},
+		{StatusIdle, StatusStopped, true},
+		{StatusIdle, StatusConnected, false},
+	}
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestTransitionEvents(t *testing.T) {
+	bus := newEventBus()
+	events, unsubscribe := bus.subscribe()
+	defer unsubscribe()
+	rt := newRunningTunnel(testTunnel("a"), bus)
+
+	steps := []struct {
+		to      TunnelStatus
+		msg     string
+		ok      bool
+		publish bool
+	}{
+		{StatusConnected, "", false, false}, // not allowed from Stopped
+		{StatusConnecting, "", true, true},
+		{StatusConnecting, "", true, false}, // nothing changed
+		{StatusConnecting, "waiting", true, true},
+		{StatusConnected, "", true, true},
+		{StatusStopped, "", true, true},
+	}
+	for i, s := range steps {
+		if ok := rt.transition(s.to, s.msg); ok != s.ok {
+			t.Fatalf("step %d: transition(%s, %q) = %v, want %v", i, s.to, s.msg, ok, s.ok)
+		}
+		select {
+		case ev := <-events:
+			if !s.publish {
+				t.Fatalf("step %d: unexpected event %+v", i, ev)
+			}
+			if ev.To != s.to || ev.ErrorMsg != s.msg {
+				t.Fatalf("step %d: event to %s %q, want %s %q", i, ev.To, ev.ErrorMsg, s.to, s.msg)
+			}
+		default:
+			if s.publish {
+				t.Fatalf("step %d: no event published", i)
+			}
+		}
+	}
+	if got := rt.Status(); got != StatusStopped {
+		t.Fatalf("Status() = %s, want Stopped", got)
+	}
+	if rt.transitionFrom(StatusConnected, StatusStopped, "") {
+		t.Fatal("transitionFrom applied although the tunnel is not in the given status")
+	}
+}
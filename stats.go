@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ForwardStats counts traffic for one forward of a running tunnel and keeps
+// a table of its currently open connections. "In" is data read from the
+// client side, "Out" is data written back to it.
+type ForwardStats struct {
+	BytesIn      atomic.Int64
+	BytesOut     atomic.Int64
+	Active       atomic.Int64
+	Total        atomic.Int64
+	DialFailures atomic.Int64
+	Blocked      atomic.Int64 // destinations refused by the forward's rules
+
+	mu     sync.Mutex
+	conns  map[uint64]*TrackedConn
+	nextID uint64
+
+	// Throughput sampling, see throughput
+	rateAt          time.Time
+	rateIn, rateOut int64
+	lastIn, lastOut float64
+}
+
+// TrackedConn is one open connection through a forward.
+type TrackedConn struct {
+	id         uint64
+	ClientAddr string
+	Target     string
+	Started    time.Time
+	BytesIn    atomic.Int64
+	BytesOut   atomic.Int64
+}
+
+func newForwardStats() *ForwardStats {
+	return &ForwardStats{conns: make(map[uint64]*TrackedConn)}
+}
+
+// open registers a new connection. The returned TrackedConn must be
+// passed to close once the connection ends.
+func (fs *ForwardStats) open(clientAddr, target string) *TrackedConn {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.nextID++
+	tc := &TrackedConn{
+		id:         fs.nextID,
+		ClientAddr: clientAddr,
+		Target:     target,
+		Started:    time.Now(),
+	}
+	fs.conns[tc.id] = tc
+	fs.Active.Add(1)
+	fs.Total.Add(1)
+	return tc
+}
+
+func (fs *ForwardStats) close(tc *TrackedConn) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.conns[tc.id]; ok {
+		delete(fs.conns, tc.id)
+		fs.Active.Add(-1)
+	}
+}
+
+// connections returns the open connections, oldest first.
+func (fs *ForwardStats) connections() []*TrackedConn {
+	fs.mu.Lock()
+	out := make([]*TrackedConn, 0, len(fs.conns))
+	for _, tc := range fs.conns {
+		out = append(out, tc)
+	}
+	fs.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+// countingWriter adds every byte written to both a per-connection and a
+// per-forward counter, so the connection table updates while data flows.
+type countingWriter struct {
+	w    io.Writer
+	conn *atomic.Int64
+	fwd  *atomic.Int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.conn.Add(int64(n))
+	cw.fwd.Add(int64(n))
+	return n, err
+}
+
+// connLimits are the per-connection timeouts of a forward, zero meaning
+// none, and the rate limiters each direction is written through.
+type connLimits struct {
+	idle     time.Duration
+	lifetime time.Duration
+	upload   []*rateLimiter
+	download []*rateLimiter
+}
+
+// closeWrite half-closes conn if it supports it, so the peer sees EOF
+// while data can still flow the other way.
+func closeWrite(conn io.Writer) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+// pipe copies data both ways between the client and remote connections,
+// counting bytes into tc and fs. When one direction reaches EOF the other
+// end is half-closed and the remaining direction may finish, for as long
+// as it takes unless a limit says otherwise. Both connections are closed
+// once both directions are done, on an error, or when a limit expires.
+// It returns why the connection ended.
+func pipe(client, remote io.ReadWriteCloser, fs *ForwardStats, tc *TrackedConn, limits connLimits) string {
+	type dirResult struct {
+		side string
+		err  error
+	}
+	done := make(chan dirResult, 2)
+	safeGo(func() {
+		_, err := io.Copy(throttle(countingWriter{remote, &tc.BytesIn, &fs.BytesIn}, limits.upload...), client)
+		closeWrite(remote)
+		done <- dirResult{"client", err}
+	})
+	safeGo(func() {
+		_, err := io.Copy(throttle(countingWriter{client, &tc.BytesOut, &fs.BytesOut}, limits.download...), remote)
+		closeWrite(client)
+		done <- dirResult{"remote", err}
+	})
+	defer client.Close()
+	defer remote.Close()
+
+	var lifetime <-chan time.Time
+	if limits.lifetime > 0 {
+		t := time.NewTimer(limits.lifetime)
+		defer t.Stop()
+		lifetime = t.C
+	}
+	// Idle is measured by the byte counters not moving
+	var idleTick <-chan time.Time
+	lastBytes := int64(-1)
+	lastActive := time.Now()
+	if limits.idle > 0 {
+		t := time.NewTicker(min(limits.idle/4, time.Second))
+		defer t.Stop()
+		idleTick = t.C
+	}
+
+	reason := ""
+	for finished := 0; finished < 2; {
+		select {
+		case r := <-done:
+			finished++
+			if reason == "" {
+				reason = closeReason(r.side, r.err)
+			}
+			if r.err != nil {
+				return reason
+			}
+		case <-lifetime:
+			return "max lifetime reached"
+		case now := <-idleTick:
+			if n := tc.BytesIn.Load() + tc.BytesOut.Load(); n != lastBytes {
+				lastBytes, lastActive = n, now
+			} else if now.Sub(lastActive) >= limits.idle {
+				return "idle timeout"
+			}
+		}
+	}
+	return reason
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/driver/desktop"
+)
+
+// setupTray adds a system tray menu when the driver supports one. With a
+// tray, closing the main window only hides it; tunnels keep running until
+// Quit is chosen from the tray.
+func (state *AppState) setupTray(a fyne.App, w fyne.Window) bool {
+	desk, ok := a.(desktop.App)
+	if !ok {
+		return false
+	}
+	state.tray = desk
+	state.refreshTray()
+	w.SetCloseIntercept(func() { w.Hide() })
+	return true
+}
+
+// refreshTray rebuilds the tray menu from the current configs and
+// statuses. Must run on the UI goroutine.
+func (state *AppState) refreshTray() {
+	if state.tray == nil {
+		return
+	}
+	items := []*fyne.MenuItem{
+		fyne.NewMenuItem("Show Window", func() {
+			state.window.Show()
+			state.window.RequestFocus()
+		}),
+		fyne.NewMenuItemSeparator(),
+	}
+	for _, cfg := range state.configs {
+		id := cfg.ID
+		status := StatusStopped
+		if rt, ok := state.getRunning(id); ok {
+			status = rt.Status()
+		}
+		item := fyne.NewMenuItem(fmt.Sprintf("%s (%s)", cfg.Name, status), func() {
+			state.toggleTunnel(id)
+		})
+		item.Checked = status.isUp() || status == StatusConnecting
+		items = append(items, item)
+	}
+	if len(state.configs) == 0 {
+		none := fyne.NewMenuItem("No tunnels configured", nil)
+		none.Disabled = true
+		items = append(items, none)
+	}
+	state.tray.SetSystemTrayMenu(fyne.NewMenu("SSH Tunnels", items...))
+}
+
+// toggleTunnel stops a connected or connecting tunnel and starts any
+// other. The window is brought up first if a 2FA code will be asked for.
+func (state *AppState) toggleTunnel(id string) {
+	if rt, ok := state.getRunning(id); ok {
+		switch rt.Status() {
+		case StatusConnected, StatusConnecting, StatusIdle:
+			state.stopTunnel(id)
+			return
+		}
+	}
+	idx := state.configIndex(id)
+	if idx < 0 {
+		return
+	}
+	if cfg := state.configs[idx]; cfg.Auth.Use2FA && !cfg.OnDemand && !state.hasSSHConnection(cfg) {
+		state.window.Show()
+		state.window.RequestFocus()
+	}
+	state.startTunnel(id, state.window)
+}
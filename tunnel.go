@@ -1,64 +1,168 @@
 package main
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"strconv"
-	"strings"
 	"time"
 	
+	"golang.org/x/crypto/ssh"
 )
 
 func safeGo(fn func()) {
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("Recovered in goroutine: %v", r)
+				slog.Error("Recovered in goroutine", "panic", r)
 			}
 		}()
 		fn()
 	}()
 }
 
+// activeForward is the runtime side of one ForwardConfig: what its accept
+// loop and connection handlers share.
+type activeForward struct {
+	index int
+	cfg   ForwardConfig
+	stats *ForwardStats
+	log   *slog.Logger
+	slots chan struct{} // nil when connections are unlimited
+
+	upload, download *rateLimiter
+	acl              *sourceACL // nil when every client is accepted
+	dest             *destRules // nil when every destination is allowed
+	dns              *dnsForwarder
+}
+
+func (rt *RunningTunnel) newActiveForward(i int, f ForwardConfig) (*activeForward, error) {
+	acl, err := newSourceACL(f)
+	if err != nil {
+		return nil, fmt.Errorf("forward %s: %w", forwardLabel(f), err)
+	}
+	dest, err := compileDestRules(f.DestRules)
+	if err != nil {
+		return nil, fmt.Errorf("forward %s: %w", forwardLabel(f), err)
+	}
+	af := &activeForward{
+		index:    i,
+		cfg:      f,
+		stats:    rt.stats[i],
+		log:      rt.log.With("forward", forwardLabel(f)),
+		upload:   newRateLimiter(f.UploadLimit),
+		download: newRateLimiter(f.DownloadLimit),
+		acl:      acl,
+		dest:     dest,
+	}
+	if f.MaxConns > 0 {
+		af.slots = make(chan struct{}, f.MaxConns)
+	}
+	return af, nil
+}
+
+// acquireSlot reserves room for one more connection, failing when the
+// forward is at max_connections.
+func (af *activeForward) acquireSlot() bool {
+	if af.slots == nil {
+		return true
+	}
+	select {
+	case af.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (af *activeForward) releaseSlot() {
+	if af.slots != nil {
+		<-af.slots
+	}
+}
+
+func (rt *RunningTunnel) limits(af *activeForward) connLimits {
+	return connLimits{
+		idle:     time.Duration(af.cfg.IdleTimeout) * time.Second,
+		lifetime: time.Duration(af.cfg.MaxLifetime) * time.Second,
+		upload:   []*rateLimiter{af.upload, rt.upload},
+		download: []*rateLimiter{af.download, rt.download},
+	}
+}
+
+// target is the address connections accepted by this forward are sent to.
+func (af *activeForward) target() string {
+	if af.cfg.Type == ForwardRemote {
+		return af.cfg.LocalAddr
+	}
+	return af.cfg.RemoteAddr
+}
+
 func (rt *RunningTunnel) start(twoFACode string, state *AppState) error {
 	// Set status to connecting at the start
-	rt.Status = StatusConnecting
-	rt.ErrorMsg = ""
+	if !rt.transition(StatusConnecting, "") {
+		return fmt.Errorf("tunnel is %s", rt.Status())
+	}
 	
 	// First, ensure we don't have any leftover resources
 	rt.cleanupResources()
 	
-	client, err := state.getSSHConnection(rt.Cfg, twoFACode)
-	if err != nil {
-		log.Printf("Failed to start tunnel: %v", err)
-		rt.Status = StatusError
-		rt.ErrorMsg = err.Error()
-		return err
+	// On-demand tunnels only bind their listeners here and connect when
+	// the first client arrives
+	var client *ssh.Client
+	if !rt.Cfg.OnDemand {
+		var err error
+		client, err = state.getSSHConnection(rt.Cfg, twoFACode)
+		if err != nil {
+			rt.log.Error("Failed to start tunnel", "err", err)
+			if isAuthError(err) {
+				metrics.incAuthFailures(rt.Cfg)
+			}
+			rt.transition(StatusError, err.Error())
+			return err
+		}
 	}
 	
-	rt.Client = client
-	rt.stopped = make(chan struct{})
-	rt.LastHeartbeat = time.Now()
+	stopped := make(chan struct{})
+	rt.mu.Lock()
+	rt.client = client
+	rt.state = state
+	rt.stopped = stopped
+	rt.lastHeartbeat = time.Now()
+	rt.mu.Unlock()
+
+	// A failed start gives back what it took, including its reference to
+	// the shared SSH connection so a broken client isn't reused
+	fail := func(err error) error {
+		rt.transition(StatusError, err.Error())
+		rt.cleanupResources()
+		state.releaseSSHConnection(rt)
+		return err
+	}
 
 	// Try to set up all forwards
-	for _, f := range rt.Cfg.Forwards {
+	var firstErr error
+	for i, f := range rt.Cfg.Forwards {
+		af, err := rt.newActiveForward(i, f)
+		if err != nil {
+			return fail(err)
+		}
 		var setupErr error
 		switch f.Type {
 		case ForwardLocal:
-			ln, err := net.Listen("tcp", f.LocalAddr)
+			ln, err := listenForward(f)
 			if err != nil {
-				log.Printf("Failed to listen on %s: %v", f.LocalAddr, err)
+				af.log.Warn("Failed to listen", "addr", f.LocalAddr, "err", err)
 				// If port is in use, it might be from a previous disconnected tunnel
-				if strings.Contains(err.Error(), "address already in use") || strings.Contains(err.Error(), "bind: address already in use") {
-					log.Printf("Port %s appears to be in use, attempting to find and clean up old resources", f.LocalAddr)
+				if isAddrInUse(err) {
+					af.log.Info("Port appears to be in use, retrying", "addr", f.LocalAddr)
 					// Try to wait a bit and retry
 					time.Sleep(1 * time.Second)
-					ln, err = net.Listen("tcp", f.LocalAddr)
+					ln, err = listenForward(f)
 					if err != nil {
-						setupErr = fmt.Errorf("port %s still in use after cleanup attempt: %w", f.LocalAddr, err)
+						setupErr = rt.portInUse(f.LocalAddr, err)
 					}
 				} else {
 					setupErr = fmt.Errorf("listen on %s failed: %w", f.LocalAddr, err)
@@ -66,30 +170,40 @@ func (rt *RunningTunnel) start(twoFACode string, state *AppState) error {
 			}
 			
 			if setupErr == nil {
-				log.Printf("Listening on %s", f.LocalAddr)
-				rt.closers = append(rt.closers, ln)
+				af.log.Info("Listening", "addr", ln.Addr().String())
+				rt.setBound(i, ln.Addr().String())
+				rt.addCloser(ln)
 				rt.wg.Add(1)
-				safeGo(func() { rt.acceptLoop(ln, f.RemoteAddr, false) })
+				safeGo(func() { rt.acceptLoop(ln, stopped, af) })
 			}
 		case ForwardRemote:
+			if rt.Cfg.OnDemand {
+				setupErr = fmt.Errorf("remote forward %s needs a connection and cannot be on demand", f.RemoteAddr)
+				break
+			}
+			// Wait for the server's answer so a refused or allocated port
+			// is known before the tunnel counts as connected
+			ln, err := listenRemote(client, f.RemoteAddr)
+			if err != nil {
+				af.log.Error("Remote listen failed", "addr", f.RemoteAddr, "err", err)
+				setupErr = err
+				break
+			}
+			af.log.Info("Remote listening", "addr", ln.Addr().String())
+			rt.setBound(i, ln.Addr().String())
+			rt.addCloser(ln)
 			rt.wg.Add(1)
-			safeGo(func() { 
-				if err := rt.remoteForward(f); err != nil {
-					log.Printf("Remote forward failed: %v", err)
-					rt.Status = StatusError
-					rt.ErrorMsg = err.Error()
-				}
-			})
+			safeGo(func() { rt.acceptLoop(ln, stopped, af) })
 		case ForwardDynamic:
-			ln, err := net.Listen("tcp", f.LocalAddr)
+			ln, err := listenForward(f)
 			if err != nil {
-				log.Printf("Failed to listen on SOCKS port %s: %v", f.LocalAddr, err)
-				if strings.Contains(err.Error(), "address already in use") || strings.Contains(err.Error(), "bind: address already in use") {
-					log.Printf("SOCKS port %s appears to be in use, attempting cleanup and retry", f.LocalAddr)
+				af.log.Warn("Failed to listen on SOCKS port", "addr", f.LocalAddr, "err", err)
+				if isAddrInUse(err) {
+					af.log.Info("SOCKS port appears to be in use, retrying", "addr", f.LocalAddr)
 					time.Sleep(1 * time.Second)
-					ln, err = net.Listen("tcp", f.LocalAddr)
+					ln, err = listenForward(f)
 					if err != nil {
-						setupErr = fmt.Errorf("SOCKS port %s still in use after cleanup: %w", f.LocalAddr, err)
+						setupErr = rt.portInUse(f.LocalAddr, err)
 					}
 				} else {
 					setupErr = fmt.Errorf("SOCKS listen on %s failed: %w", f.LocalAddr, err)
@@ -97,55 +211,113 @@ func (rt *RunningTunnel) start(twoFACode string, state *AppState) error {
 			}
 			
 			if setupErr == nil {
-				log.Printf("SOCKS proxy listening on %s", f.LocalAddr)
-				rt.closers = append(rt.closers, ln)
+				af.log.Info("SOCKS proxy listening", "addr", ln.Addr().String())
+				rt.setBound(i, ln.Addr().String())
+				rt.addCloser(ln)
 				rt.wg.Add(1)
-				safeGo(func() { rt.acceptLoop(ln, "", true) })
+				safeGo(func() { rt.acceptLoop(ln, stopped, af) })
+			}
+		case ForwardDNS:
+			// TCP first, so an allocated port is then taken for UDP too
+			ln, err := listenForward(f)
+			if err != nil {
+				setupErr = rt.portInUse(f.LocalAddr, err)
+				break
 			}
+			bound := ln.Addr().String()
+			pc, err := net.ListenPacket("udp", bound)
+			if err != nil {
+				ln.Close()
+				setupErr = fmt.Errorf("DNS listen on %s/udp failed: %w", bound, err)
+				break
+			}
+			rt.addCloser(ln)
+			rt.addCloser(pc)
+			rt.setBound(i, bound)
+			af.dns = rt.newDNSForwarder(af)
+			af.log.Info("DNS forwarder listening", "addr", bound, "server", f.RemoteAddr)
+			rt.wg.Add(2)
+			safeGo(func() { rt.dnsUDPLoop(pc, stopped, af.dns) })
+			safeGo(func() { rt.acceptLoop(ln, stopped, af) })
 		}
 		
 		if setupErr != nil {
-			rt.Status = StatusError
-			rt.ErrorMsg = setupErr.Error()
+			rt.setForwardErr(i, setupErr)
+			if rt.Cfg.bestEffort() {
+				af.log.Error("Forward failed to start, continuing with the others", "err", setupErr)
+				if firstErr == nil {
+					firstErr = setupErr
+				}
+				continue
+			}
 			// Clean up any resources we did manage to create
-			rt.cleanupResources()
-			return setupErr
+			return fail(setupErr)
+		}
+	}
+	
+	// Under best effort, carry on as long as one forward is up
+	var degraded string
+	if firstErr != nil {
+		up, total := rt.forwardsUp()
+		if up == 0 {
+			return fail(firstErr)
 		}
+		degraded = fmt.Sprintf("%d of %d forwards failed, %s", total-up, total, rt.firstForwardErr())
+		rt.log.Warn("Tunnel started with failed forwards", "up", up, "total", total)
 	}
 	
-	// If we get here, all forwards were set up successfully
-	rt.Status = StatusConnected
-	rt.LastHeartbeat = time.Now()
-	log.Printf("Tunnel successfully started for %s@%s:%d", rt.Cfg.Auth.User, rt.Cfg.SSHHost, rt.Cfg.SSHPort)
+	// A concurrent stop() wins over a late successful start. It may have
+	// cleaned up before the listeners and client above were in place, so
+	// those are released here.
+	abandon := func() error {
+		err := fmt.Errorf("tunnel was %s while starting", rt.Status())
+		rt.cleanupResources()
+		state.releaseSSHConnection(rt)
+		return err
+	}
+	if rt.Cfg.OnDemand {
+		if !rt.transitionFrom(StatusConnecting, StatusIdle, "") {
+			return abandon()
+		}
+		rt.wg.Add(1)
+		safeGo(func() { rt.idleMonitor(stopped) })
+		rt.log.Info("Tunnel listening, will connect on demand", "ssh", connectionKey(rt.Cfg))
+		return nil
+	}
+	if !rt.transitionFrom(StatusConnecting, StatusConnected, degraded) {
+		return abandon()
+	}
+	rt.log.Info("Tunnel successfully started", "ssh", connectionKey(rt.Cfg))
 	
 	return nil
 }
 
+func (rt *RunningTunnel) addCloser(c io.Closer) {
+	rt.mu.Lock()
+	rt.closers = append(rt.closers, c)
+	rt.mu.Unlock()
+}
+
 // New helper method to clean up resources
 func (rt *RunningTunnel) cleanupResources() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Panic during resource cleanup: %v", r)
+			rt.log.Error("Panic during resource cleanup", "panic", r)
 		}
 	}()
 	
-	// Close any existing listeners
-	for i, c := range rt.closers {
-		if c != nil {
-			func() {
-				defer func() {
-					if r := recover(); r != nil {
-						log.Printf("Panic closing resource %d: %v", i, r)
-					}
-				}()
-				c.Close()
-			}()
-		}
-	}
-	rt.closers = nil // Clear the slice
+	rt.mu.Lock()
+	closers := rt.closers
+	rt.closers = nil
+	rt.bound = nil
+	rt.forwardErrs = nil
+	stopped := rt.stopped
+	rt.stopped = nil
+	rt.mu.Unlock()
 	
-	// Close stopped channel if it exists
-	if rt.stopped != nil {
+	// Close stopped channel if it exists, before the listeners, so accept
+	// loops can tell a cleanup from a listener failing
+	if stopped != nil {
 		func() {
 			defer func() {
 				if r := recover(); r != nil {
@@ -153,20 +325,33 @@ func (rt *RunningTunnel) cleanupResources() {
 				}
 			}()
 			select {
-			case <-rt.stopped:
+			case <-stopped:
 				// Already closed
 			default:
-				close(rt.stopped)
+				close(stopped)
 			}
 		}()
-		rt.stopped = nil
+	}
+	
+	// Close any existing listeners
+	for i, c := range closers {
+		if c != nil {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						rt.log.Error("Panic closing resource", "index", i, "panic", r)
+					}
+				}()
+				c.Close()
+			}()
+		}
 	}
 }
 
 func (rt *RunningTunnel) stop(state *AppState) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Panic in tunnel stop recovered: %v", r)
+			rt.log.Error("Panic in tunnel stop recovered", "panic", r)
 		}
 	}()
 
@@ -176,57 +361,26 @@ func (rt *RunningTunnel) stop(state *AppState) {
 		return
 	}
 	rt.stopping = true
-	rt.Status = StatusStopped
 	rt.mu.Unlock()
+	if state != nil {
+		state.stopDependents(rt.Cfg.ID)
+	}
+	rt.transition(StatusStopped, "")
 
-	log.Printf("Stopping tunnel for %s@%s:%d", rt.Cfg.Auth.User, rt.Cfg.SSHHost, rt.Cfg.SSHPort)
+	rt.log.Info("Stopping tunnel", "ssh", connectionKey(rt.Cfg))
 
 	// Use the new cleanup method
 	rt.cleanupResources()
 
 	// Handle SSH connection cleanup with better error handling
-	if rt.Client != nil {
-		key := fmt.Sprintf("%s@%s:%d", rt.Cfg.Auth.User, rt.Cfg.SSHHost, rt.Cfg.SSHPort)
-		
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Printf("Panic in SSH connection cleanup: %v", r)
-				}
-			}()
-			
-			state.connMu.Lock()
-			defer state.connMu.Unlock()
-			
-			if conn, exists := state.connections[key]; exists {
-				conn.mu.Lock()
-				conn.refCount--
-				if conn.refCount <= 0 {
-					log.Printf("Closing SSH connection for %s", key)
-					func() {
-						defer func() {
-							if r := recover(); r != nil {
-								log.Printf("Panic closing SSH client: %v", r)
-							}
-						}()
-						rt.Client.Close()
-					}()
-					delete(state.connections, key)
-				} else {
-					log.Printf("Keeping SSH connection for %s (refCount: %d)", key, conn.refCount)
-					rt.Client = nil // Avoid closing shared client
-				}
-				conn.mu.Unlock()
-			}
-		}()
-	}
+	state.releaseSSHConnection(rt)
 	
 	// Wait for goroutines to finish with timeout
 	done := make(chan struct{})
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("Panic waiting for goroutines: %v", r)
+				rt.log.Error("Panic waiting for goroutines", "panic", r)
 			}
 		}()
 		rt.wg.Wait()
@@ -235,32 +389,37 @@ func (rt *RunningTunnel) stop(state *AppState) {
 	
 	select {
 	case <-done:
-		log.Printf("All goroutines stopped cleanly for %s@%s:%d", rt.Cfg.Auth.User, rt.Cfg.SSHHost, rt.Cfg.SSHPort)
+		rt.log.Debug("All goroutines stopped cleanly")
 	case <-time.After(5 * time.Second):
-		log.Printf("Timeout waiting for goroutines to stop for %s@%s:%d", rt.Cfg.Auth.User, rt.Cfg.SSHHost, rt.Cfg.SSHPort)
+		rt.log.Warn("Timeout waiting for goroutines to stop")
 	}
 	
-	log.Printf("Tunnel stopped for %s@%s:%d", rt.Cfg.Auth.User, rt.Cfg.SSHHost, rt.Cfg.SSHPort)
+	rt.log.Info("Tunnel stopped", "ssh", connectionKey(rt.Cfg))
 }
 
-func (rt *RunningTunnel) acceptLoop(ln net.Listener, remoteAddr string, dynamic bool) {
+// reject closes a connection acceptLoop won't serve, logging and auditing
+// the reason.
+func (rt *RunningTunnel) reject(af *activeForward, conn net.Conn, reason string) {
+	af.log.Warn("Connection rejected", "remote", conn.RemoteAddr().String(), "reason", reason)
+	ac := rt.newAuditConn(af, conn)
+	ac.reason = reason
+	conn.Close()
+	ac.finish()
+}
+
+func (rt *RunningTunnel) acceptLoop(ln net.Listener, stopped <-chan struct{}, af *activeForward) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Accept loop panic recovered: %v", r)
-			rt.mu.Lock()
-			if rt.Status == StatusConnected {
-				rt.Status = StatusError
-				rt.ErrorMsg = fmt.Sprintf("Accept loop crashed: %v", r)
-			}
-			rt.mu.Unlock()
+			af.log.Error("Accept loop panic recovered", "panic", r)
+			rt.transitionFrom(StatusConnected, StatusError, fmt.Sprintf("Accept loop crashed: %v", r))
 		}
 		rt.wg.Done()
 	}()
 	
 	for {
 		select {
-		case <-rt.stopped:
-			log.Printf("Accept loop stopping for %s", remoteAddr)
+		case <-stopped:
+			af.log.Debug("Accept loop stopping")
 			return
 		default:
 		}
@@ -270,168 +429,158 @@ func (rt *RunningTunnel) acceptLoop(ln net.Listener, remoteAddr string, dynamic
 			if rt.isStopping() {
 				return
 			}
-			log.Printf("Accept error: %v", err)
+			select {
+			case <-stopped:
+				// Closed by cleanup
+				return
+			default:
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				// Closed under us, such as a remote listener whose SSH
+				// connection went away
+				af.log.Warn("Listener closed", "err", err)
+				rt.forwardFailed(af.index, fmt.Errorf("listener closed: %w", err))
+				return
+			}
+			af.log.Warn("Accept error", "err", err)
 			// Don't set error status for temporary accept errors
 			continue
 		}
-		log.Printf("Accepted connection from %s", conn.RemoteAddr())
-		if dynamic {
-			safeGo(func() { rt.handleSOCKS(conn) })
-		} else {
-			safeGo(func() { rt.handleDirectForward(conn, remoteAddr) })
+		af.log.Debug("Accepted connection", "remote", conn.RemoteAddr().String())
+		if ok, why := af.acl.permits(conn.RemoteAddr()); !ok {
+			rt.reject(af, conn, why)
+			continue
+		}
+		if !af.acquireSlot() {
+			rt.reject(af, conn, "connection limit reached")
+			continue
+		}
+		switch af.cfg.Type {
+		case ForwardDynamic:
+			safeGo(func() {
+				defer af.releaseSlot()
+				rt.handleSOCKS(conn, af)
+			})
+		case ForwardDNS:
+			safeGo(func() {
+				defer af.releaseSlot()
+				rt.handleDNSTCP(conn, af, af.dns)
+			})
+		default:
+			safeGo(func() {
+				defer af.releaseSlot()
+				rt.handleDirectForward(conn, af)
+			})
 		}
 	}
 }
 
-func (rt *RunningTunnel) handleDirectForward(conn net.Conn, remoteAddr string) {
+func (rt *RunningTunnel) handleDirectForward(conn net.Conn, af *activeForward) {
 	defer conn.Close()
-	log.Printf("Dialing remote %s", remoteAddr)
-	
-	// Check if client is still valid
-	if rt.Client == nil {
-		log.Printf("SSH client is nil, cannot forward to %s", remoteAddr)
-		return
-	}
+	ac := rt.newAuditConn(af, conn)
+	defer ac.finish()
+	fs := af.stats
+	remoteAddr := af.target()
+	ac.target = remoteAddr
+	lg := af.log.With("remote", conn.RemoteAddr().String(), "target", remoteAddr)
+	lg.Debug("Dialing remote")
+	tc := fs.open(conn.RemoteAddr().String(), remoteAddr)
+	defer fs.close(tc)
+	ac.tc = tc
 	
-	rc, err := rt.Client.Dial("tcp", remoteAddr)
-	if err != nil {
-		log.Printf("Dial remote %s failed: %v", remoteAddr, err)
-		// This could indicate connection issues
-		rt.mu.Lock()
-		if rt.Status == StatusConnected {
-			rt.Status = StatusError
-			rt.ErrorMsg = fmt.Sprintf("Failed to dial %s: %v", remoteAddr, err)
+	dialStart := time.Now()
+	var rc net.Conn
+	var err error
+	if af.cfg.Type == ForwardRemote {
+		// Connections from the server go to a service on this side
+		rc, err = net.DialTimeout("tcp", remoteAddr, 10*time.Second)
+		if err != nil {
+			lg.Warn("Dial local target failed", "err", err)
+			fs.DialFailures.Add(1)
+			ac.reason = "dial failed: " + err.Error()
+			return
+		}
+	} else {
+		// Check if client is still valid
+		client, err := rt.acquireClient()
+		if err != nil {
+			lg.Warn("No SSH connection, cannot forward", "err", err)
+			ac.reason = "no ssh client: " + err.Error()
+			return
+		}
+		rc, err = client.Dial("tcp", remoteAddr)
+		if err != nil {
+			lg.Error("Dial remote failed", "err", err)
+			fs.DialFailures.Add(1)
+			ac.reason = "dial failed: " + err.Error()
+			// This could indicate connection issues
+			rt.transitionFrom(StatusConnected, StatusError, fmt.Sprintf("Failed to dial %s: %v", remoteAddr, err))
+			return
 		}
-		rt.mu.Unlock()
-		return
 	}
 	defer rc.Close()
+	metrics.observeDial(rt.Cfg, time.Since(dialStart))
 	
-	log.Printf("Connected to remote %s", remoteAddr)
-	rt.LastHeartbeat = time.Now() // Update heartbeat on successful connection
+	lg.Debug("Connected to remote")
+	rt.touch() // Update heartbeat on successful connection
 	
-	safeGo(func() { _, _ = io.Copy(rc, conn) })
-	_, _ = io.Copy(conn, rc)
+	ac.reason = pipe(conn, rc, fs, tc, rt.limits(af))
 }
 
-func (rt *RunningTunnel) handleSOCKS(conn net.Conn) {
+func (rt *RunningTunnel) handleSOCKS(conn net.Conn, af *activeForward) {
 	defer conn.Close()
-	buf := make([]byte, 256)
-	n, err := conn.Read(buf)
-	if err != nil || n < 3 {
-		log.Printf("SOCKS handshake read failed: %v", err)
-		return
-	}
-	if buf[0] != 5 {
-		log.Printf("Invalid SOCKS version: %d", buf[0])
-		return
-	}
-	_, _ = conn.Write([]byte{5, 0})
-	n, err = conn.Read(buf)
-	if err != nil || n < 10 {
-		log.Printf("SOCKS request read failed: %v", err)
-		return
-	}
-	if buf[0] != 5 || buf[1] != 1 {
-		log.Printf("Invalid SOCKS request: version=%d, command=%d", buf[0], buf[1])
-		return
-	}
-	var host string
-	var port int
-	switch buf[3] {
-	case 1: // IPv4
-		if n < 10 {
-			log.Printf("Invalid SOCKS IPv4 request length: %d", n)
-			return
-		}
-		host = fmt.Sprintf("%d.%d.%d.%d", buf[4], buf[5], buf[6], buf[7])
-		port = int(binary.BigEndian.Uint16(buf[8:10]))
-	case 3: // Domain name
-		if n < 7 {
-			log.Printf("Invalid SOCKS domain request length: %d", n)
-			return
-		}
-		hostLen := int(buf[4])
-		if n < 5+hostLen+2 {
-			log.Printf("Insufficient SOCKS domain request length: %d", n)
-			return
-		}
-		host = string(buf[5 : 5+hostLen])
-		port = int(binary.BigEndian.Uint16(buf[5+hostLen : 5+hostLen+2]))
-	case 4: // IPv6
-		log.Printf("SOCKS IPv6 not supported")
-		_, _ = conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
-		return
-	default:
-		log.Printf("Unsupported SOCKS address type: %d", buf[3])
-		_, _ = conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+	ac := rt.newAuditConn(af, conn)
+	defer ac.finish()
+	ac.reason = "socks handshake failed"
+	fs := af.stats
+	lg := af.log.With("remote", conn.RemoteAddr().String())
+	host, port, err := readSOCKSRequest(conn)
+	if err != nil {
+		lg.Warn("SOCKS handshake failed", "err", err)
 		return
 	}
 	
 	target := net.JoinHostPort(host, strconv.Itoa(port))
+	ac.target = target
+	lg = lg.With("target", target)
+	if !af.dest.permits(host, port) {
+		lg.Warn("SOCKS destination blocked by rules")
+		fs.Blocked.Add(1)
+		ac.reason = "blocked by destination rules"
+		socksReply(conn, socksNotAllowed)
+		return
+	}
+	tc := fs.open(conn.RemoteAddr().String(), target)
+	defer fs.close(tc)
+	ac.tc = tc
 	
 	// Check if client is still valid
-	if rt.Client == nil {
-		log.Printf("SSH client is nil, cannot SOCKS forward to %s", target)
-		_, _ = conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+	client, err := rt.acquireClient()
+	if err != nil {
+		lg.Warn("No SSH connection, cannot SOCKS forward", "err", err)
+		ac.reason = "no ssh client: " + err.Error()
+		socksReply(conn, socksGeneralFailure)
 		return
 	}
 	
-	rc, err := rt.Client.Dial("tcp", target)
+	dialStart := time.Now()
+	rc, err := client.Dial("tcp", target)
 	if err != nil {
-		log.Printf("SOCKS dial to %s failed: %v", target, err)
-		_, _ = conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		lg.Error("SOCKS dial failed", "err", err)
+		fs.DialFailures.Add(1)
+		ac.reason = "dial failed: " + err.Error()
+		socksReply(conn, socksGeneralFailure)
 		// This could indicate connection issues
-		rt.mu.Lock()
-		if rt.Status == StatusConnected {
-			rt.Status = StatusError
-			rt.ErrorMsg = fmt.Sprintf("SOCKS dial failed: %v", err)
-		}
-		rt.mu.Unlock()
+		rt.transitionFrom(StatusConnected, StatusError, fmt.Sprintf("SOCKS dial failed: %v", err))
 		return
 	}
 	defer rc.Close()
+	metrics.observeDial(rt.Cfg, time.Since(dialStart))
 	
-	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
-	rt.LastHeartbeat = time.Now() // Update heartbeat on successful connection
-	
-	safeGo(func() { _, _ = io.Copy(rc, conn) })
-	_, _ = io.Copy(conn, rc)
-}
-
-func (rt *RunningTunnel) remoteForward(f ForwardConfig) error {
-	defer rt.wg.Done()
-	
-	if rt.Client == nil {
-		return fmt.Errorf("SSH client is nil")
-	}
-	
-	ln, err := rt.Client.Listen("tcp", f.RemoteAddr)
-	if err != nil {
-		log.Printf("Remote listen on %s failed: %v", f.RemoteAddr, err)
-		return fmt.Errorf("remote listen on %s failed: %w", f.RemoteAddr, err)
-	}
-	defer ln.Close()
-	
-	log.Printf("Remote listening on %s", f.RemoteAddr)
-	rt.acceptLoop(ln, f.LocalAddr, false)
-	return nil
-}
-
-func (rt *RunningTunnel) dynamicForward(localAddr string) error {
-	defer rt.wg.Done()
-	
-	ln, err := net.Listen("tcp", localAddr)
-	if err != nil {
-		log.Printf("Listen on %s failed: %v", localAddr, err)
-		return fmt.Errorf("listen on %s failed: %w", localAddr, err)
-	}
-	defer ln.Close()
+	socksReply(conn, socksSucceeded)
+	rt.touch() // Update heartbeat on successful connection
 	
-	rt.closers = append(rt.closers, ln)
-	log.Printf("SOCKS proxy listening on %s", localAddr)
-	rt.acceptLoop(ln, "", true)
-	return nil
+	ac.reason = pipe(conn, rc, fs, tc, rt.limits(af))
 }
 
 func (rt *RunningTunnel) isStopping() bool {
@@ -439,28 +588,3 @@ func (rt *RunningTunnel) isStopping() bool {
 	defer rt.mu.Unlock()
 	return rt.stopping
 }
-
-// Health check method to verify if the tunnel is still working
-func (rt *RunningTunnel) isHealthy() bool {
-	rt.mu.Lock()
-	defer rt.mu.Unlock()
-	
-	if rt.Status != StatusConnected || rt.Client == nil {
-		return false
-	}
-	
-	// Check if it's been too long since last activity
-	if time.Since(rt.LastHeartbeat) > 2*time.Minute {
-		// Try a simple operation to verify connection
-		session, err := rt.Client.NewSession()
-		if err != nil {
-			rt.Status = StatusDisconnected
-			rt.ErrorMsg = "Connection lost"
-			return false
-		}
-		session.Close()
-		rt.LastHeartbeat = time.Now()
-	}
-	
-	return true
-}
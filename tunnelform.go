@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// defaultProxyPort is shown for a new proxy and used when the field is
+// left empty.
+const defaultProxyPort = 8080
+
+// tunnelForm holds the fields the add and edit dialogs share. The dialog
+// shows the tunnel's settings and its first forward.
+type tunnelForm struct {
+	shown TunnelConfig // what the fields were filled from
+
+	name, sshHost, sshPort           *widget.Entry
+	user, password, keyPath, keyPass *widget.Entry
+	use2FA, autoStart, onDemand      *widget.Check
+	idleTimeout                      *widget.Entry
+	mute, bestEffort                 *widget.Check
+	dependsOn                        *dependencyPicker
+	backups                          *widget.Entry
+	race                             *widget.Check
+	forwardType                      *widget.Select
+	localAddr, remoteAddr            *widget.Entry
+	connIdle, maxLifetime, maxConns  *widget.Entry
+	allow, deny, destRules           *widget.Entry
+	dnsDomains, dnsFallback          *widget.Entry
+	fwdUpload, fwdDownload           *widget.Entry
+	upload, download                 *widget.Entry
+	useProxy, proxyTLS               *widget.Check
+	proxyHost, proxyPort             *widget.Entry
+	proxyUser, proxyPass             *widget.Entry
+	testButton                       *widget.Button
+}
+
+// newTunnelForm builds the fields filled in from cfg, which is the zero
+// config for a new tunnel.
+func (state *AppState) newTunnelForm(cfg TunnelConfig, w fyne.Window) *tunnelForm {
+	f := &tunnelForm{shown: cfg}
+	entry := func(placeholder, text string) *widget.Entry {
+		e := widget.NewEntry()
+		e.SetPlaceHolder(placeholder)
+		e.SetText(text)
+		return e
+	}
+	secret := func(placeholder, text string) *widget.Entry {
+		e := widget.NewPasswordEntry()
+		e.SetPlaceHolder(placeholder)
+		e.SetText(text)
+		return e
+	}
+	check := func(label string, checked bool) *widget.Check {
+		c := widget.NewCheck(label, nil)
+		c.SetChecked(checked)
+		return c
+	}
+	// Zero means unset, and leaves the placeholder showing
+	count := func(n int) string {
+		if n > 0 {
+			return strconv.Itoa(n)
+		}
+		return ""
+	}
+
+	port := cfg.SSHPort
+	if port == 0 {
+		port = 22
+	}
+	f.name = entry("My SSH Tunnel", cfg.Name)
+	f.sshHost = entry("abc.com", cfg.SSHHost)
+	f.sshPort = entry("", strconv.Itoa(port))
+	f.user = entry("SSH Username", cfg.Auth.User)
+	f.password = secret("SSH Password (optional)", cfg.Auth.Password)
+	f.keyPath = entry("/path/to/ssh/key (optional)", cfg.Auth.KeyPath)
+	f.keyPass = secret("Key Passphrase (optional)", cfg.Auth.KeyPassphrase)
+	f.use2FA = check("Enable 2FA", cfg.Auth.Use2FA)
+	f.autoStart = check("Start when the app launches", cfg.AutoStart)
+	f.onDemand = check("Connect on demand", cfg.OnDemand)
+	f.idleTimeout = entry("300", count(cfg.IdleTimeout))
+	f.mute = check("Mute notifications", cfg.MuteNotifications)
+	f.bestEffort = check("Start even if some forwards fail", cfg.bestEffort())
+	f.dependsOn = state.dependencyPicker(cfg.ID, cfg.DependsOn)
+	f.backups = entry("bastion2.example.com:22, ...", formatEndpoints(cfg.Endpoints))
+	f.race = check("Try all servers at once", cfg.RaceEndpoints)
+
+	var first ForwardConfig
+	if len(cfg.Forwards) > 0 {
+		first = cfg.Forwards[0]
+	}
+	f.forwardType = widget.NewSelect([]string{"Local", "Remote", "Dynamic (SOCKS)", "DNS"}, nil)
+	f.forwardType.SetSelected(first.Type.String())
+	f.localAddr = entry("127.0.0.1:1234", first.LocalAddr)
+	f.remoteAddr = entry("123.123.123.123:22", first.RemoteAddr)
+	f.connIdle = entry("0", count(first.IdleTimeout))
+	f.maxLifetime = entry("0", count(first.MaxLifetime))
+	f.maxConns = entry("0", count(first.MaxConns))
+	f.allow = entry("10.0.0.0/8, 192.168.1.20", strings.Join(first.Allow, ", "))
+	f.deny = entry("10.0.5.0/24", strings.Join(first.Deny, ", "))
+	f.destRules = widget.NewMultiLineEntry()
+	f.destRules.SetPlaceHolder("allow *.corp.example.com 443\ndeny 10.0.0.0/8\nallow * 80,443")
+	f.destRules.SetText(formatDestRules(first.DestRules))
+	f.dnsDomains = entry("corp.example.com, internal", strings.Join(first.DNSDomains, ", "))
+	f.dnsFallback = entry("1.1.1.1:53", first.DNSFallback)
+	f.fwdUpload = entry("0", count(first.UploadLimit))
+	f.fwdDownload = entry("0", count(first.DownloadLimit))
+	f.upload = entry("0", count(cfg.UploadLimit))
+	f.download = entry("0", count(cfg.DownloadLimit))
+
+	proxy := ProxyConfig{Port: defaultProxyPort}
+	if cfg.Proxy != nil {
+		proxy = *cfg.Proxy
+	}
+	f.useProxy = check("Use HTTP Proxy", cfg.Proxy != nil)
+	f.proxyHost = entry("proxy.company.com", proxy.Host)
+	f.proxyPort = entry("", strconv.Itoa(proxy.Port))
+	f.proxyUser = entry("proxy_username", proxy.Username)
+	f.proxyPass = secret("proxy_password", proxy.Password)
+	f.proxyTLS = check("HTTPS Proxy", proxy.TLS)
+
+	f.testButton = widget.NewButtonWithIcon("Test Connection", theme.SearchIcon(), func() {
+		// Test the other forwards too, as they are stored
+		test, err := f.apply(cfg)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		state.showDiagnostics(test, w)
+	})
+	return f
+}
+
+func (f *tunnelForm) items() []*widget.FormItem {
+	return []*widget.FormItem{
+		{Text: "Name:", Widget: f.name},
+		{Text: "SSH Host:", Widget: f.sshHost},
+		{Text: "SSH Port:", Widget: f.sshPort},
+		{Text: "Backup Servers:", Widget: f.backups, HintText: "Tried in order when the SSH host is unreachable"},
+		{Text: "", Widget: f.race},
+		{Text: "Username:", Widget: f.user},
+		{Text: "Password:", Widget: f.password},
+		{Text: "Key Path:", Widget: f.keyPath},
+		{Text: "Key Passphrase:", Widget: f.keyPass},
+		{Text: "", Widget: f.use2FA},
+		{Text: "", Widget: f.autoStart},
+		{Text: "", Widget: f.onDemand},
+		{Text: "Idle Timeout:", Widget: f.idleTimeout, HintText: "Seconds without clients before an on-demand tunnel disconnects"},
+		{Text: "", Widget: f.mute},
+		{Text: "", Widget: f.bestEffort},
+		{Text: "Depends On:", Widget: f.dependsOn.group, HintText: "Started first; stopping them stops this tunnel"},
+		{Text: "Forward Type:", Widget: f.forwardType},
+		{Text: "Local Address:", Widget: f.localAddr},
+		{Text: "Remote Address:", Widget: f.remoteAddr},
+		{Text: "Connection Idle Timeout:", Widget: f.connIdle, HintText: "Seconds without traffic before a forwarded connection is closed; 0 for none"},
+		{Text: "Connection Max Lifetime:", Widget: f.maxLifetime, HintText: "Seconds before a forwarded connection is closed; 0 for none"},
+		{Text: "Max Connections:", Widget: f.maxConns, HintText: "Further connections are refused; 0 for no limit"},
+		{Text: "Allow Clients From:", Widget: f.allow, HintText: "Comma separated CIDRs; empty allows any client"},
+		{Text: "Deny Clients From:", Widget: f.deny, HintText: "Comma separated CIDRs; checked before the allow list"},
+		{Text: "Destination Rules:", Widget: f.destRules, HintText: "SOCKS only; one allow or deny rule per line, first match wins; a CIDR deny also blocks host names"},
+		{Text: "DNS Domains:", Widget: f.dnsDomains, HintText: "DNS only; resolved through the tunnel, empty for all names"},
+		{Text: "DNS Fallback:", Widget: f.dnsFallback, HintText: "DNS only; server for other names, empty to refuse them"},
+		{Text: "Forward Upload Limit:", Widget: f.fwdUpload, HintText: "KiB/s from clients of this forward; 0 for no limit"},
+		{Text: "Forward Download Limit:", Widget: f.fwdDownload, HintText: "KiB/s to clients of this forward; 0 for no limit"},
+		{Text: "Tunnel Upload Limit:", Widget: f.upload, HintText: "KiB/s across all forwards; 0 for no limit"},
+		{Text: "Tunnel Download Limit:", Widget: f.download, HintText: "KiB/s across all forwards; 0 for no limit"},
+		{Text: "", Widget: f.useProxy},
+		{Text: "Proxy Host:", Widget: f.proxyHost},
+		{Text: "Proxy Port:", Widget: f.proxyPort},
+		{Text: "Proxy User:", Widget: f.proxyUser},
+		{Text: "Proxy Pass:", Widget: f.proxyPass},
+		{Text: "", Widget: f.proxyTLS},
+		{Text: "", Widget: f.testButton, HintText: "Checks each step of connecting with the settings above"},
+	}
+}
+
+// parseCount reads a non-negative whole number field, empty meaning 0.
+// A typo must not be saved as 0, which for limits means none.
+func parseCount(label, unit, s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: %q is not a whole number of %s", label, s, unit)
+	}
+	return n, nil
+}
+
+// parsePort reads a port field, empty meaning def.
+func parsePort(label, s string, def int) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > 65535 {
+		return 0, fmt.Errorf("%s: %q is not a port number", label, s)
+	}
+	return n, nil
+}
+
+// apply returns base with the form's settings and first forward, keeping
+// what the form doesn't show, or why a field is invalid.
+func (f *tunnelForm) apply(base TunnelConfig) (TunnelConfig, error) {
+	port, err := parsePort("SSH Port", f.sshPort.Text, 22)
+	if err != nil {
+		return base, err
+	}
+	endpoints, err := parseEndpoints(f.backups.Text)
+	if err != nil {
+		return base, err
+	}
+	if f.onDemand.Checked && f.forwardType.Selected == "Remote" {
+		return base, fmt.Errorf("remote forwards cannot be on demand")
+	}
+	var first ForwardConfig
+	if len(base.Forwards) > 0 {
+		first = base.Forwards[0]
+	}
+	type countField struct {
+		dst         *int
+		label, unit string
+		entry       *widget.Entry
+	}
+	for _, c := range []countField{
+		{&base.IdleTimeout, "Idle Timeout", "seconds", f.idleTimeout},
+		{&base.UploadLimit, "Tunnel Upload Limit", "KiB/s", f.upload},
+		{&base.DownloadLimit, "Tunnel Download Limit", "KiB/s", f.download},
+		{&first.IdleTimeout, "Connection Idle Timeout", "seconds", f.connIdle},
+		{&first.MaxLifetime, "Connection Max Lifetime", "seconds", f.maxLifetime},
+		{&first.MaxConns, "Max Connections", "connections", f.maxConns},
+		{&first.UploadLimit, "Forward Upload Limit", "KiB/s", f.fwdUpload},
+		{&first.DownloadLimit, "Forward Download Limit", "KiB/s", f.fwdDownload},
+	} {
+		n, err := parseCount(c.label, c.unit, c.entry.Text)
+		if err != nil {
+			return base, err
+		}
+		*c.dst = n
+	}
+	allow, deny := splitList(f.allow.Text), splitList(f.deny.Text)
+	if _, err := newSourceACL(ForwardConfig{Allow: allow, Deny: deny}); err != nil {
+		return base, err
+	}
+	destRules, err := parseDestRules(f.destRules.Text)
+	if err != nil {
+		return base, err
+	}
+	var proxy *ProxyConfig
+	if f.useProxy.Checked {
+		proxyPort, err := parsePort("Proxy Port", f.proxyPort.Text, defaultProxyPort)
+		if err != nil {
+			return base, err
+		}
+		proxy = &ProxyConfig{
+			Host:     f.proxyHost.Text,
+			Port:     proxyPort,
+			Username: f.proxyUser.Text,
+			Password: f.proxyPass.Text,
+			TLS:      f.proxyTLS.Checked,
+		}
+	}
+
+	base.Name = f.name.Text
+	base.SSHHost = f.sshHost.Text
+	base.SSHPort = port
+	base.Auth = SSHAuthConfig{
+		User:          f.user.Text,
+		Password:      f.password.Text,
+		KeyPath:       f.keyPath.Text,
+		KeyPassphrase: f.keyPass.Text,
+		Use2FA:        f.use2FA.Checked,
+	}
+	base.Proxy = proxy
+	if f.backups.Text != formatEndpoints(f.shown.Endpoints) {
+		// Only renumber priorities when the list was edited
+		base.Endpoints = endpoints
+	}
+	base.RaceEndpoints = f.race.Checked
+	base.DependsOn = f.dependsOn.selected()
+	base.AutoStart = f.autoStart.Checked
+	base.OnDemand = f.onDemand.Checked
+	base.MuteNotifications = f.mute.Checked
+	base.StartPolicy = startPolicy(f.bestEffort.Checked)
+	first.Type = parseForwardType(f.forwardType.Selected)
+	first.LocalAddr = f.localAddr.Text
+	first.RemoteAddr = f.remoteAddr.Text
+	first.Allow = allow
+	first.Deny = deny
+	first.DestRules = destRules
+	first.DNSDomains = splitList(f.dnsDomains.Text)
+	first.DNSFallback = strings.TrimSpace(f.dnsFallback.Text)
+	base.Forwards = append([]ForwardConfig{first}, otherForwards(base.Forwards)...)
+	return base, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestParseCount(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"", 0, false},
+		{" 12 ", 12, false},
+		{"0", 0, false},
+		{"-1", 0, true},
+		{"1.5", 0, true},
+		{"ten", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCount("Max connections", "connections", tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseCount(%q) = %d, %v, want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"", defaultProxyPort, false},
+		{" 2222 ", 2222, false},
+		{"1", 1, false},
+		{"65535", 65535, false},
+		{"0", 0, true},
+		{"65536", 0, true},
+		{"ssh", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePort("Proxy port", tt.in, defaultProxyPort)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parsePort(%q) = %d, %v, want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
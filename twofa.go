@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// twoFAPrompt is a pending prompt for the 2FA code of one SSH server.
+// Every tunnel that asks while it is pending waits for the same answer,
+// since they will share the connection it opens.
+type twoFAPrompt struct {
+	key     string
+	cfg     TunnelConfig
+	w       fyne.Window
+	waiters []func(code string, ok bool)
+}
+
+func (p *twoFAPrompt) resolve(code string, ok bool) {
+	for _, done := range p.waiters {
+		done(code, ok)
+	}
+}
+
+// requestTwoFA asks for a 2FA code for cfg. Prompts are shown one at a
+// time, so starting several 2FA tunnels at once queues them up, and
+// tunnels on the same server are answered by a single prompt.
+func (state *AppState) requestTwoFA(cfg TunnelConfig, w fyne.Window, done func(code string, ok bool)) {
+	key := connectionKey(cfg)
+	if p := state.twoFAActive; p != nil && p.key == key {
+		p.waiters = append(p.waiters, done)
+		return
+	}
+	for _, p := range state.twoFAQueue {
+		if p.key == key {
+			p.waiters = append(p.waiters, done)
+			return
+		}
+	}
+	state.twoFAQueue = append(state.twoFAQueue, &twoFAPrompt{key: key, cfg: cfg, w: w, waiters: []func(string, bool){done}})
+	if state.twoFAActive == nil {
+		state.nextTwoFA()
+	}
+}
+
+func (state *AppState) nextTwoFA() {
+	state.twoFAActive = nil
+	for len(state.twoFAQueue) > 0 {
+		p := state.twoFAQueue[0]
+		state.twoFAQueue = state.twoFAQueue[1:]
+		// An earlier prompt may have connected to the same server
+		if state.hasSSHConnection(p.cfg) {
+			p.resolve("", true)
+			continue
+		}
+		state.twoFAActive = p
+		codeEntry := widget.NewEntry()
+		codeEntry.SetPlaceHolder("Enter 2FA code")
+		d := dialog.NewForm("2FA Required: "+p.cfg.Name, "Connect", "Cancel", []*widget.FormItem{
+			{Text: "Code:", Widget: codeEntry},
+		}, func(confirm bool) {
+			p.resolve(codeEntry.Text, confirm)
+			state.nextTwoFA()
+		}, p.w)
+		d.Show()
+		return
+	}
+}
+
+// promptTwoFA asks for a 2FA code from a background goroutine, bringing
+// the main window up, and waits for the answer. Running headless, it asks
+// on the terminal instead.
+func (state *AppState) promptTwoFA(cfg TunnelConfig) (string, bool) {
+	if state.headless {
+		return state.terminalTwoFA(cfg)
+	}
+	type answer struct {
+		code string
+		ok   bool
+	}
+	ch := make(chan answer, 1)
+	fyne.Do(func() {
+		state.window.Show()
+		state.window.RequestFocus()
+		state.requestTwoFA(cfg, state.window, func(code string, ok bool) {
+			ch <- answer{code, ok}
+		})
+	})
+	a := <-ch
+	return a.code, a.ok
+}
+
+// terminalTwoFA asks for a 2FA code on the terminal. A tunnel that waited
+// for the terminal behind another on the same server shares its
+// connection instead of asking again.
+func (state *AppState) terminalTwoFA(cfg TunnelConfig) (string, bool) {
+	terminalMu.Lock()
+	defer terminalMu.Unlock()
+	if state.hasSSHConnection(cfg) {
+		return "", true
+	}
+	fmt.Fprintln(os.Stderr, "2FA Required: "+cfg.Name)
+	answers, err := readTerminalAnswers([]string{"Code: "}, []bool{true})
+	if err != nil {
+		slog.Error("Failed to read 2FA code", "tunnel", cfg.ID, "err", err)
+		return "", false
+	}
+	code := strings.TrimSpace(answers[0])
+	return code, code != ""
+}
+
+// autoStartTunnels starts every tunnel marked to start with the app.
+func (state *AppState) autoStartTunnels(w fyne.Window) {
+	for _, cfg := range state.configs {
+		if cfg.AutoStart {
+			state.startTunnel(cfg.ID, w)
+		}
+	}
+}
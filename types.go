@@ -1,16 +1,24 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"net"
+	"net/http"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 	
 	"golang.org/x/crypto/ssh"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/driver/desktop"
 	"fyne.io/fyne/v2/widget"
+	"github.com/fsnotify/fsnotify"
 )
 
 type ForwardType int
@@ -19,6 +27,7 @@ const (
 	ForwardLocal ForwardType = iota
 	ForwardRemote
 	ForwardDynamic
+	ForwardDNS
 )
 
 func (ft ForwardType) String() string {
@@ -29,11 +38,29 @@ func (ft ForwardType) String() string {
 		return "Remote"
 	case ForwardDynamic:
 		return "Dynamic (SOCKS)"
+	case ForwardDNS:
+		return "DNS"
 	default:
 		return "Unknown"
 	}
 }
 
+// key is the short lowercase name used in metrics labels and audit records.
+func (ft ForwardType) key() string {
+	switch ft {
+	case ForwardLocal:
+		return "local"
+	case ForwardRemote:
+		return "remote"
+	case ForwardDynamic:
+		return "dynamic"
+	case ForwardDNS:
+		return "dns"
+	default:
+		return "unknown"
+	}
+}
+
 type TunnelStatus int
 
 const (
@@ -42,6 +69,7 @@ const (
 	StatusConnected
 	StatusError
 	StatusDisconnected
+	StatusIdle
 )
 
 func (s TunnelStatus) String() string {
@@ -56,6 +84,8 @@ func (s TunnelStatus) String() string {
 		return "Error"
 	case StatusDisconnected:
 		return "Disconnected"
+	case StatusIdle:
+		return "Idle"
 	default:
 		return "Unknown"
 	}
@@ -65,6 +95,31 @@ type ForwardConfig struct {
 	Type       ForwardType `json:"type"`
 	LocalAddr  string      `json:"local_addr"`
 	RemoteAddr string      `json:"remote_addr"`
+
+	// Per-connection limits; zero means none. Timeouts are in seconds.
+	IdleTimeout int `json:"idle_timeout,omitempty"`
+	MaxLifetime int `json:"max_lifetime,omitempty"`
+	MaxConns    int `json:"max_connections,omitempty"`
+
+	// Bandwidth limits in KiB/s; upload is data from the client
+	UploadLimit   int `json:"upload_limit,omitempty"`
+	DownloadLimit int `json:"download_limit,omitempty"`
+
+	// Client source CIDRs; deny wins, and a non-empty allow list admits
+	// only the clients it matches
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	// Destinations a SOCKS forward may reach, first match wins
+	DestRules []DestRule `json:"dest_rules,omitempty"`
+
+	// DNS forwards: names under DNSDomains (all names when empty) go to
+	// RemoteAddr over the tunnel, the rest to DNSFallback directly
+	DNSDomains  []string `json:"dns_domains,omitempty"`
+	DNSFallback string   `json:"dns_fallback,omitempty"`
+
+	// Ports tried when LocalAddr's port is "auto", as "lo-hi"
+	PortRange string `json:"port_range,omitempty"`
 }
 
 type ProxyConfig struct {
@@ -84,21 +139,49 @@ type SSHAuthConfig struct {
 }
 
 type TunnelConfig struct {
+	ID       string          `json:"id"`
 	Name     string          `json:"name"`
 	SSHHost  string          `json:"ssh_host"`
 	SSHPort  int             `json:"ssh_port"`
 	Auth     SSHAuthConfig   `json:"auth"`
 	Proxy    *ProxyConfig    `json:"proxy,omitempty"`
 	Forwards []ForwardConfig `json:"forwards"`
+
+	// Backup SSH servers, and whether to dial them all at once
+	Endpoints     []SSHEndpoint `json:"endpoints,omitempty"`
+	RaceEndpoints bool          `json:"race_endpoints,omitempty"`
+
+	DependsOn         []string `json:"depends_on,omitempty"`
+	AutoStart         bool     `json:"auto_start,omitempty"`
+	OnDemand          bool     `json:"on_demand,omitempty"`
+	IdleTimeout       int      `json:"idle_timeout,omitempty"` // seconds, on-demand only
+	MuteNotifications bool     `json:"mute_notifications,omitempty"`
+
+	// Aggregate bandwidth limits over all forwards, in KiB/s
+	UploadLimit   int `json:"upload_limit,omitempty"`
+	DownloadLimit int `json:"download_limit,omitempty"`
+
+	// "all" or "best_effort", see forwardstatus.go
+	StartPolicy string `json:"start_policy,omitempty"`
 }
 
 type RunningTunnel struct {
 	Cfg           TunnelConfig
-	Status        TunnelStatus
-	ErrorMsg      string
-	LastHeartbeat time.Time
-	Client        *ssh.Client
+	status        TunnelStatus
+	errorMsg      string
+	lastHeartbeat time.Time
+	client        *ssh.Client
+	events        *eventBus
+	stats         []*ForwardStats
+	upload        *rateLimiter // aggregate limits, nil when unlimited
+	download      *rateLimiter
+	routed        atomic.Int64 // open router connections through this tunnel
+	log           *slog.Logger
+	state         *AppState
+	dialMu        sync.Mutex // serialises on-demand connects and idle teardown
 	closers       []io.Closer
+	bound         []string // listening address per forward, on the server for remote ones
+	forwardErrs   []string // why each forward is down, "" when up
 	wg            sync.WaitGroup
 	mu            sync.Mutex
 	stopping      bool
@@ -107,19 +190,155 @@ type RunningTunnel struct {
 
 type sshConnection struct {
 	client   *ssh.Client
+	endpoint SSHEndpoint
 	mu       sync.Mutex
 	refCount int
 }
 
 type AppState struct {
-	configs      []TunnelConfig
-	running      map[int]*RunningTunnel
-	list         *widget.List
-	status       *widget.Label
-	selectedIdx  int
-	connections  map[string]*sshConnection
-	connMu       sync.Mutex
-	statusTicker *time.Ticker
+	configs       []TunnelConfig
+	running       map[string]*RunningTunnel
+	runMu         sync.Mutex
+	events        *eventBus
+	list          *widget.List
+	status        *widget.Label
+	details       *detailPane
+	selectedIdx   int
+	connections   map[string]*sshConnection
+	connMu        sync.Mutex
+	statusTicker  *time.Ticker
+	watcher       *fsnotify.Watcher
+	settings      AppSettings
+	settingsFile  string
+	metricsServer *http.Server
+	router        *router
+	logWindow     fyne.Window
+	logFile       *rotatingWriter
+	auditFile     *rotatingWriter
+	window        fyne.Window
+	tray          desktop.App
+	twoFAQueue    []*twoFAPrompt
+	twoFAActive   *twoFAPrompt // the prompt on screen, if any
+	dialing       map[string]*pendingDial
+	headless      bool // no window, see runHeadless
+
+	failbackTicker *time.Ticker // see startFailbackMonitor
+
+	// Copy of configs for goroutines other than the UI's, see publishConfigs
+	snapMu  sync.Mutex
+	snapCfg []TunnelConfig
+}
+
+// newTunnelID returns a random (version 4) UUID used to identify a tunnel
+// independently of its position in the list.
+func newTunnelID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// assignTunnelIDs gives every config without an ID a fresh one and reports
+// whether anything changed, so callers know to write the file back.
+func assignTunnelIDs(cfgs []TunnelConfig) bool {
+	changed := false
+	for i := range cfgs {
+		if cfgs[i].ID == "" {
+			cfgs[i].ID = newTunnelID()
+			changed = true
+		}
+	}
+	return changed
+}
+
+// validateConfigs checks that every tunnel has a usable SSH endpoint and
+// well-formed forward addresses for its forward type.
+func validateConfigs(cfgs []TunnelConfig) error {
+	ids := make(map[string]bool)
+	for i, cfg := range cfgs {
+		name := cfg.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if cfg.ID != "" {
+			if ids[cfg.ID] {
+				return fmt.Errorf("tunnel %s: duplicate id %s", name, cfg.ID)
+			}
+			ids[cfg.ID] = true
+		}
+		if cfg.SSHHost == "" {
+			return fmt.Errorf("tunnel %s: ssh_host is empty", name)
+		}
+		if cfg.SSHPort < 1 || cfg.SSHPort > 65535 {
+			return fmt.Errorf("tunnel %s: invalid ssh_port %d", name, cfg.SSHPort)
+		}
+		for j, ep := range cfg.Endpoints {
+			if ep.Host == "" {
+				return fmt.Errorf("tunnel %s: endpoint %d: host is empty", name, j+1)
+			}
+			if ep.Port < 1 || ep.Port > 65535 {
+				return fmt.Errorf("tunnel %s: endpoint %d: invalid port %d", name, j+1, ep.Port)
+			}
+		}
+		if cfg.IdleTimeout < 0 {
+			return fmt.Errorf("tunnel %s: invalid idle_timeout %d", name, cfg.IdleTimeout)
+		}
+		if cfg.UploadLimit < 0 || cfg.DownloadLimit < 0 {
+			return fmt.Errorf("tunnel %s: bandwidth limits must not be negative", name)
+		}
+		switch cfg.StartPolicy {
+		case "", startAll, startBestEffort:
+		default:
+			return fmt.Errorf("tunnel %s: invalid start_policy %q (want %q or %q)", name, cfg.StartPolicy, startAll, startBestEffort)
+		}
+		for j, f := range cfg.Forwards {
+			if f.IdleTimeout < 0 || f.MaxLifetime < 0 || f.MaxConns < 0 || f.UploadLimit < 0 || f.DownloadLimit < 0 {
+				return fmt.Errorf("tunnel %s: forward %d: limits must not be negative", name, j+1)
+			}
+			if _, err := newSourceACL(f); err != nil {
+				return fmt.Errorf("tunnel %s: forward %d: %w", name, j+1, err)
+			}
+			if _, err := compileDestRules(f.DestRules); err != nil {
+				return fmt.Errorf("tunnel %s: forward %d: %w", name, j+1, err)
+			}
+			if f.Type == ForwardRemote && isAutoAddr(f.LocalAddr) {
+				return fmt.Errorf("tunnel %s: forward %d: a remote forward's local_addr needs a fixed port", name, j+1)
+			}
+			if _, _, err := parsePortRange(f.PortRange); err != nil {
+				return fmt.Errorf("tunnel %s: forward %d: %w", name, j+1, err)
+			}
+			if cfg.OnDemand && f.Type == ForwardRemote {
+				return fmt.Errorf("tunnel %s: forward %d: remote forwards cannot be on demand", name, j+1)
+			}
+			switch f.Type {
+			case ForwardLocal, ForwardRemote, ForwardDNS:
+				if _, _, err := net.SplitHostPort(f.LocalAddr); err != nil {
+					return fmt.Errorf("tunnel %s: forward %d: invalid local_addr %q: %w", name, j+1, f.LocalAddr, err)
+				}
+				if _, _, err := net.SplitHostPort(f.RemoteAddr); err != nil {
+					return fmt.Errorf("tunnel %s: forward %d: invalid remote_addr %q: %w", name, j+1, f.RemoteAddr, err)
+				}
+				if _, port, _ := net.SplitHostPort(f.RemoteAddr); f.Type == ForwardRemote && port == autoPort {
+					return fmt.Errorf("tunnel %s: forward %d: a remote forward's remote_addr takes port 0, not auto, to let the server pick", name, j+1)
+				}
+				if f.DNSFallback != "" {
+					if _, _, err := net.SplitHostPort(f.DNSFallback); err != nil {
+						return fmt.Errorf("tunnel %s: forward %d: invalid dns_fallback %q: %w", name, j+1, f.DNSFallback, err)
+					}
+				}
+			case ForwardDynamic:
+				if _, _, err := net.SplitHostPort(f.LocalAddr); err != nil {
+					return fmt.Errorf("tunnel %s: forward %d: invalid local_addr %q: %w", name, j+1, f.LocalAddr, err)
+				}
+			default:
+				return fmt.Errorf("tunnel %s: forward %d: unknown type %d", name, j+1, f.Type)
+			}
+		}
+	}
+	return validateDependencies(cfgs)
 }
 
 func saveConfigFile(cfgs []TunnelConfig, file string) error {
@@ -135,7 +354,7 @@ func loadConfigFile(file string) ([]TunnelConfig, error) {
 	if err != nil {
 		// If file doesn't exist, try to find and migrate from old locations
 		if os.IsNotExist(err) {
-			log.Printf("Config file %s not found, checking for existing configs to migrate", file)
+			slog.Info("Config file not found, checking for existing configs to migrate", "path", file)
 			return migrateConfigFromOldLocations(file)
 		}
 		return []TunnelConfig{}, err
@@ -143,11 +362,49 @@ func loadConfigFile(file string) ([]TunnelConfig, error) {
 	var cfgs []TunnelConfig
 	err = json.Unmarshal(data, &cfgs)
 	if err != nil {
-		log.Printf("Error parsing config file: %v", err)
+		slog.Error("Error parsing config file", "err", err)
 		return []TunnelConfig{}, err
 	}
-	log.Printf("Loaded %d tunnel configurations from %s", len(cfgs), file)
-	return cfgs, err
+	if assignTunnelIDs(cfgs) {
+		slog.Info("Assigned IDs to tunnels", "path", file)
+		if err := saveConfigFile(cfgs, file); err != nil {
+			slog.Error("Failed to save tunnel IDs", "err", err)
+		}
+	}
+	if err := validateDependencies(cfgs); err != nil {
+		// Dependent tunnels would wait forever; start them on their own
+		slog.Error("Ignoring tunnel dependencies", "err", err)
+		for i := range cfgs {
+			cfgs[i].DependsOn = nil
+		}
+	}
+	slog.Info("Loaded tunnel configurations", "count", len(cfgs), "path", file)
+	// Keep the tunnels so nothing is lost on the next save, but report what
+	// hot reload would reject until the file is fixed
+	return cfgs, validateConfigs(cfgs)
+}
+
+// readConfigFile parses and validates a config file without the migration
+// fallback of loadConfigFile. Used when reloading after external edits.
+func readConfigFile(file string) ([]TunnelConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []TunnelConfig
+	if err := json.Unmarshal(data, &cfgs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", file, err)
+	}
+	if err := validateConfigs(cfgs); err != nil {
+		return nil, err
+	}
+	if assignTunnelIDs(cfgs) {
+		// Tunnels added by hand get their IDs persisted right away
+		if err := saveConfigFile(cfgs, file); err != nil {
+			slog.Error("Failed to save tunnel IDs", "err", err)
+		}
+	}
+	return cfgs, nil
 }
 
 func migrateConfigFromOldLocations(newPath string) ([]TunnelConfig, error) {
@@ -169,23 +426,24 @@ func migrateConfigFromOldLocations(newPath string) ([]TunnelConfig, error) {
 	
 	for _, oldPath := range oldLocations {
 		if data, err := os.ReadFile(oldPath); err == nil {
-			log.Printf("Found existing config at %s, migrating to %s", oldPath, newPath)
+			slog.Info("Migrating existing config", "from", oldPath, "to", newPath)
 			
 			var cfgs []TunnelConfig
 			if err := json.Unmarshal(data, &cfgs); err == nil {
+				assignTunnelIDs(cfgs)
 				// Save to new location
 				if saveErr := saveConfigFile(cfgs, newPath); saveErr == nil {
-					log.Printf("Successfully migrated %d configurations to %s", len(cfgs), newPath)
+					slog.Info("Migrated configurations", "count", len(cfgs), "path", newPath)
 					return cfgs, nil
 				} else {
-					log.Printf("Failed to save migrated config: %v", saveErr)
+					slog.Error("Failed to save migrated config", "err", saveErr)
 				}
 			} else {
-				log.Printf("Failed to parse old config file %s: %v", oldPath, err)
+				slog.Error("Failed to parse old config file", "path", oldPath, "err", err)
 			}
 		}
 	}
 	
-	log.Printf("No existing config found, starting with empty configuration")
+	slog.Info("No existing config found, starting with empty configuration")
 	return []TunnelConfig{}, nil
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testTunnel returns a config that passes validateConfigs.
+func testTunnel(id string) TunnelConfig {
+	return TunnelConfig{
+		ID:      id,
+		Name:    "tunnel " + id,
+		SSHHost: "ssh.example.com",
+		SSHPort: 22,
+		Auth:    SSHAuthConfig{User: "me", Password: "secret"},
+		Forwards: []ForwardConfig{
+			{Type: ForwardLocal, LocalAddr: "127.0.0.1:8080", RemoteAddr: "intranet:80"},
+		},
+	}
+}
+
+func TestValidateConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(cfgs []TunnelConfig)
+		wantErr string // "" for a valid list
+	}{
+		{"valid", func([]TunnelConfig) {}, ""},
+		{"duplicate id", func(c []TunnelConfig) { c[1].ID = c[0].ID }, "duplicate id"},
+		{"empty host", func(c []TunnelConfig) { c[0].SSHHost = "" }, "ssh_host is empty"},
+		{"port zero", func(c []TunnelConfig) { c[0].SSHPort = 0 }, "invalid ssh_port"},
+		{"port too big", func(c []TunnelConfig) { c[0].SSHPort = 65536 }, "invalid ssh_port"},
+		{"endpoint without host", func(c []TunnelConfig) {
+			c[0].Endpoints = []SSHEndpoint{{Port: 22}}
+		}, "endpoint 1: host is empty"},
+		{"endpoint bad port", func(c []TunnelConfig) {
+			c[0].Endpoints = []SSHEndpoint{{Host: "backup", Port: 70000}}
+		}, "endpoint 1: invalid port"},
+		{"negative idle timeout", func(c []TunnelConfig) { c[0].IdleTimeout = -1 }, "invalid idle_timeout"},
+		{"negative tunnel limit", func(c []TunnelConfig) { c[0].UploadLimit = -1 }, "must not be negative"},
+		{"unknown start policy", func(c []TunnelConfig) { c[0].StartPolicy = "some" }, "invalid start_policy"},
+		{"best effort", func(c []TunnelConfig) { c[0].StartPolicy = startBestEffort }, ""},
+		{"negative forward limit", func(c []TunnelConfig) { c[0].Forwards[0].MaxConns = -1 }, "forward 1: limits must not be negative"},
+		{"bad allow entry", func(c []TunnelConfig) { c[0].Forwards[0].Allow = []string{"not-a-cidr"} }, "forward 1"},
+		{"bad dest rule", func(c []TunnelConfig) {
+			c[0].Forwards[0].DestRules = []DestRule{{Action: "maybe"}}
+		}, "forward 1"},
+		{"missing local port", func(c []TunnelConfig) { c[0].Forwards[0].LocalAddr = "127.0.0.1" }, "invalid local_addr"},
+		{"missing remote port", func(c []TunnelConfig) { c[0].Forwards[0].RemoteAddr = "intranet" }, "invalid remote_addr"},
+		{"auto local port", func(c []TunnelConfig) { c[0].Forwards[0].LocalAddr = "127.0.0.1:auto" }, ""},
+		{"bad port range", func(c []TunnelConfig) {
+			c[0].Forwards[0].LocalAddr = "127.0.0.1:auto"
+			c[0].Forwards[0].PortRange = "30000-20000"
+		}, "forward 1"},
+		{"remote forward with auto local port", func(c []TunnelConfig) {
+			c[0].Forwards[0] = ForwardConfig{Type: ForwardRemote, LocalAddr: "127.0.0.1:auto", RemoteAddr: "0.0.0.0:9000"}
+		}, "needs a fixed port"},
+		{"remote forward with auto remote port", func(c []TunnelConfig) {
+			c[0].Forwards[0] = ForwardConfig{Type: ForwardRemote, LocalAddr: "127.0.0.1:3000", RemoteAddr: "0.0.0.0:auto"}
+		}, "takes port 0"},
+		{"on-demand remote forward", func(c []TunnelConfig) {
+			c[0].OnDemand = true
+			c[0].Forwards[0] = ForwardConfig{Type: ForwardRemote, LocalAddr: "127.0.0.1:3000", RemoteAddr: "0.0.0.0:9000"}
+		}, "cannot be on demand"},
+		{"dynamic needs only a local address", func(c []TunnelConfig) {
+			c[0].Forwards[0] = ForwardConfig{Type: ForwardDynamic, LocalAddr: "127.0.0.1:1080"}
+		}, ""},
+		{"dns fallback without port", func(c []TunnelConfig) {
+			c[0].Forwards[0] = ForwardConfig{Type: ForwardDNS, LocalAddr: "127.0.0.1:5353", RemoteAddr: "10.0.0.2:53", DNSFallback: "1.1.1.1"}
+		}, "invalid dns_fallback"},
+		{"unknown forward type", func(c []TunnelConfig) { c[0].Forwards[0].Type = ForwardType(9) }, "unknown type"},
+		{"unknown dependency", func(c []TunnelConfig) { c[0].DependsOn = []string{"missing"} }, "unknown tunnel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfgs := []TunnelConfig{testTunnel("a"), testTunnel("b")}
+			tt.edit(cfgs)
+			err := validateConfigs(cfgs)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateConfigs() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateConfigs() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
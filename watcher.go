@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchConfigFile reloads the config whenever the file is changed by
+// something other than this app (an editor, config management, ...).
+// The parent directory is watched rather than the file itself so that
+// editors which save by writing a temp file and renaming it are picked up.
+func (state *AppState) watchConfigFile(configFile string, w fyne.Window) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("create config watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("watch %s: %w", filepath.Dir(configFile), err)
+	}
+	state.watcher = watcher
+	slog.Info("Watching config for changes", "path", configFile)
+
+	target := filepath.Clean(configFile)
+	safeGo(func() {
+		var debounce *time.Timer
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != target {
+					continue
+				}
+				if !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Rename) {
+					continue
+				}
+				// Editors tend to produce a burst of events per save
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(500*time.Millisecond, func() {
+					state.reloadConfigFile(configFile, w)
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("Config watcher error", "err", err)
+			}
+		}
+	})
+	return nil
+}
+
+func (state *AppState) reloadConfigFile(configFile string, w fyne.Window) {
+	cfgs, err := readConfigFile(configFile)
+	if err != nil {
+		slog.Warn("Ignoring config change, reload failed", "err", err)
+		return
+	}
+	fyne.Do(func() {
+		state.applyConfigs(cfgs, w)
+	})
+}
+
+// applyConfigs swaps in a reloaded config set. Tunnels are matched by ID:
+// running tunnels whose config is unchanged keep running, changed ones are
+// restarted and removed ones are stopped. Must be called on the UI goroutine.
+func (state *AppState) applyConfigs(cfgs []TunnelConfig, w fyne.Window) {
+	if reflect.DeepEqual(state.configs, cfgs) {
+		return
+	}
+	slog.Info("Config file changed, reloading", "count", len(cfgs))
+
+	newByID := make(map[string]TunnelConfig)
+	for _, cfg := range cfgs {
+		newByID[cfg.ID] = cfg
+	}
+
+	var toStop []*RunningTunnel
+	var toRestart []string
+	running := state.runningTunnels()
+	for id, rt := range running {
+		cfg, ok := newByID[id]
+		if !ok {
+			rt.log.Info("Tunnel removed from config, stopping")
+			toStop = append(toStop, rt)
+			state.removeRunning(id, rt)
+			continue
+		}
+		if reflect.DeepEqual(rt.Cfg, cfg) {
+			continue
+		}
+		slog.Info("Tunnel changed, restarting", "tunnel", id, "name", cfg.Name)
+		toRestart = append(toRestart, id)
+	}
+	// Stopping a tunnel stops its dependents, so restart those with it
+	for _, id := range slices.Clone(toRestart) {
+		for _, dep := range state.runningDependents(id) {
+			if _, ok := newByID[dep]; ok && !slices.Contains(toRestart, dep) {
+				toRestart = append(toRestart, dep)
+			}
+		}
+	}
+	for _, id := range toRestart {
+		toStop = append(toStop, running[id])
+		state.removeRunning(id, running[id])
+	}
+
+	state.configs = cfgs
+	state.publishConfigs()
+	state.selectedIdx = -1
+	state.list.UnselectAll()
+	state.refreshList()
+	state.updateStatus()
+
+	if len(toStop) == 0 {
+		return
+	}
+	go func() {
+		for _, rt := range toStop {
+			rt.stop(state)
+		}
+		fyne.Do(func() {
+			for _, id := range toRestart {
+				state.startTunnel(id, w)
+			}
+			state.refreshList()
+			state.updateStatus()
+		})
+	}()
+}